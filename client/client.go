@@ -1,11 +1,15 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net"
-	"strconv"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	proto "termtexter/proto"
+	"time"
 
 	"github.com/gdamore/tcell"
 	"github.com/rivo/tview"
@@ -17,184 +21,283 @@ const (
 	HTTP_BADREQUEST  = 400
 	HTTP_ERROR       = 500
 	HTTP_UNAVAILABLE = 503
+	MIN_BACKOFF      = time.Second
+	MAX_BACKOFF      = 30 * time.Second
+	PING_INTERVAL    = 15 * time.Second
+	MAX_MISSED_PONGS = 3
+	DIAL_TIMEOUT     = 10 * time.Second
 )
 
+//channels - packets the server sends us on its own, responses to our requests go through pending instead
 type channels struct {
-	getMessagesResponse chan proto.GetMessagesResponse
-	getRoomsResponse    chan proto.GetRoomsResponse
-	joinRoomResponse    chan proto.JoinRoomResponse
-	registerResponse    chan proto.RegisterResponse
-	createRoomResponse  chan proto.CreateRoomResponse
-	postMessageResponse chan proto.PostMessageResponse
-	loginResponse       chan proto.LoginResponse
-	dynamicMessage      chan proto.DynamicMessage
+	dynamicMessage chan proto.DynamicMessage
+	presence       chan proto.Presence
 }
 
 //Client - client struct
 type Client struct {
-	conn         net.Conn
-	proto        proto.Proto
-	rooms        map[int]*proto.Room
-	curRoom      int
-	curChan      int
-	loggedIn     bool
-	channels     channels
-	app          *tview.Application
-	pages        *tview.Pages
-	chat         *tview.TextView
-	users        *tview.List
-	roomtree     *tview.TreeView
-	mainmenu     *tview.Primitive
-	mainmenuform *tview.Form
-}
-
-func (c Client) check(e error) {
+	//mu guards conn, which reconnect swaps while keepAlive may be closing it, and rooms. rooms is only
+	//changed on the UI goroutine with mu held, so other goroutines lock it to read
+	mu              sync.Mutex
+	conn            net.Conn
+	addr            string
+	proto           *proto.Proto
+	rooms           map[int]*proto.Room
+	curRoom         int
+	curChan         int
+	loggedIn        atomic.Bool //resync clears it off the UI goroutine
+	Codec           string      //the codec to ask the server for, JSON if it's empty or the server doesn't know it
+	Compression     string      //the compression to ask the server for, none if it's empty
+	username        string      //who we are (or want to be) on this server, from the profile until we log in
+	challenge       string      //from a login that still needs a two-factor code, and who it was for
+	challengeUser   string
+	twofactorform   *tview.Form
+	twofactorview   *tview.TextView
+	twofactoroff    *tview.Form
+	theme           theme
+	keys            keys
+	timestampFormat string
+	notifications   notifyConfig
+	lastSeen        int64 //unix nanoseconds of the last packet from the server
+	missedPongs     int32
+	retryAfter      int64        //nanoseconds the server asked us to wait before reconnecting, when it went away on purpose
+	offline         map[int]bool //users the server told us went offline
+	channels        channels
+	pending         pending
+	app             *tview.Application
+	pages           *tview.Pages
+	chat            *tview.TextView
+	status          *tview.TextView
+	users           *tview.List
+	roomtree        *tview.TreeView
+	mainmenu        *tview.Primitive
+	mainmenuform    *tview.Form
+	mainmenuerr     *tview.TextView
+	passwordform    *tview.Form
+}
+
+func (c *Client) check(e error) {
 	if e != nil {
 		panic(e)
 	}
 }
 
-//Init - get the client socket ready
-func (c *Client) Init(host string, port int) {
+//Init - get the client socket ready. addr is host:port for TCP, or a ws:// or wss:// URL
+func (c *Client) Init(addr string) {
 	var err error
-	a, err := net.Dial("tcp", host+":"+strconv.Itoa(port))
+	c.addr = addr
+	a, err := dial(c.addr)
 	c.conn = a
 	c.check(err)
-	c.proto = proto.Proto{Conn: c.conn}
+	c.proto = proto.New(c.conn)
 
+	// make the app and pages
+	c.app = tview.NewApplication()
+	c.pages = tview.NewPages()
 	//allocate memory for the channels
-	c.channels.createRoomResponse = make(chan proto.CreateRoomResponse)
-	c.channels.getMessagesResponse = make(chan proto.GetMessagesResponse)
-	c.channels.getRoomsResponse = make(chan proto.GetRoomsResponse)
-	c.channels.joinRoomResponse = make(chan proto.JoinRoomResponse)
-	c.channels.loginResponse = make(chan proto.LoginResponse)
-	c.channels.postMessageResponse = make(chan proto.PostMessageResponse)
-	c.channels.registerResponse = make(chan proto.RegisterResponse)
 	c.channels.dynamicMessage = make(chan proto.DynamicMessage)
+	c.channels.presence = make(chan proto.Presence)
+	c.offline = make(map[int]bool)
 	//listens for incoming packets and sends to the proper channels
 	go c.packetListener()
-	// make the app and pages
-	c.app = tview.NewApplication()
-	c.pages = tview.NewPages()
+	//agree on a protocol version before anything else, there's no point going on if we can't
+	if err := c.Hello(); err != nil {
+		fmt.Println("Could not talk to the server at", c.addr+":", err)
+		os.Exit(1)
+	}
+	//makes sure the server is still there when it goes quiet
+	go c.keepAlive()
+}
+
+//Hello - tells the server which protocol versions and features we support, and remembers the ones we have in common
+func (c *Client) Hello() error {
+	msg, err := c.request(func(rid int) error {
+		var codecs []string
+		if c.Codec != "" && c.Codec != proto.CODEC_JSON {
+			codecs = []string{c.Codec}
+		}
+		var compressions []string
+		if c.Compression != "" {
+			compressions = []string{c.Compression}
+		}
+		return c.proto.SendHello(rid, codecs, compressions)
+	})
+	if err != nil {
+		return err
+	}
+	c.proto.SetFeatures(msg.(proto.HelloResponse).Features)
+	return nil
 }
 
 func (c *Client) messageHandler(chat *tview.TextView) {
 	for {
 		//block waiting for new dynamic messages
 		msg := <-c.channels.dynamicMessage
+		//the rooms and the chat belong to the UI goroutine
+		c.app.QueueUpdateDraw(func() {
+			c.addMessage(chat, msg)
+		})
+	}
+}
 
-		m := proto.Message{}
-		m.Created = msg.Created
-		m.ID = msg.ID
-		m.Message = msg.Message
-		m.Received = msg.Received
-		m.Timestamp = msg.Timestamp
-		m.Type = msg.Type
-		m.UserID = msg.UserID
+//addMessage - files a message from the server under its channel, and shows it if that's the one we're looking at.
+//Runs on the UI goroutine. After a reconnect a message can beat its room to us, those are dropped,
+//they'll be loaded with the room
+func (c *Client) addMessage(chat *tview.TextView, msg proto.DynamicMessage) {
+	m := proto.Message{}
+	m.Created = msg.Created
+	m.ID = msg.ID
+	m.Message = msg.Message
+	m.Received = msg.Received
+	m.Timestamp = msg.Timestamp
+	m.Type = msg.Type
+	m.UserID = msg.UserID
+
+	c.mu.Lock()
+	room, ok := c.rooms[msg.Room]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	channel, ok := room.Channels[msg.Channel]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+	channel.Messages = append(channel.Messages, &m)
+	sender, known := room.Users[msg.UserID]
+	c.mu.Unlock()
 
-		c.rooms[msg.Room].Channels[msg.Channel].Messages = append(c.rooms[msg.Room].Channels[msg.Channel].Messages, &m)
+	name := fmt.Sprintf("user %d", msg.UserID)
+	if known && sender != nil {
 		//TODO: do this if we're viewing the current chat, otherwise bold the channel this message would be in
-		if msg.Room == c.curRoom && msg.Channel == c.curChan {
-			chat.SetText(chat.GetText(true) + c.buildMessage(msg.Created.String(), c.rooms[c.curRoom].Users[msg.UserID].DisplayName, msg.Message))
-		} else {
-			chat.SetText("You're in the wrong castle")
-		}
+		c.notify(sender.UserName, msg.Message)
+		name = sender.DisplayName
+	}
+	if msg.Room == c.curRoom && msg.Channel == c.curChan {
+		chat.SetText(chat.GetText(true) + c.buildMessage(c.formatTime(msg.Created), name, msg.Message))
 	}
 }
 
-//GetRegistrationResponse - see what the response is
-func (c Client) GetRegistrationResponse() proto.RegisterResponse {
-	var ret proto.RegisterResponse
-	msg := <-c.channels.registerResponse
-	ret = msg
-	return ret
+//Register - registers a new account. The error explains what went wrong, if anything did
+func (c *Client) Register(username string, password string) error {
+	_, err := c.request(func(rid int) error {
+		return c.proto.SendRegistration(rid, username, password)
+	})
+	return err
 }
 
-//SendRegistration - calls the proto register
-func (c Client) SendRegistration(username string, password string) {
-	c.proto.SendRegistration(username, password)
+//CreateRoom - creates a room. The error explains what went wrong, if anything did
+func (c *Client) CreateRoom(name string, password string) error {
+	_, err := c.request(func(rid int) error {
+		return c.proto.SendCreateRoom(rid, name, password)
+	})
+	return err
 }
 
-//CreateRoom - creates a room
-func (c *Client) CreateRoom(name string, password string) int {
-	err := c.proto.SendCreateRoom(name, password)
-	c.check(err)
-	var res proto.CreateRoomResponse
-	msg := <-c.channels.createRoomResponse
-
-	res = msg
-	if res.Code == HTTP_OK {
-		//We joined the room
-		// log.Println("Successfully created the", name, "room.")
-	} else if res.Code == HTTP_BADREQUEST {
-		//The room already exists
-		// log.Println("This room already exists", name)
-	} else {
-		// log.Println("Unknown return code from the server:", res.Code)
+//JoinRoom - joins a room. This is a one time per account operation, just to link your account to a room (if you know the name and password). The error explains what went wrong, if anything did
+func (c *Client) JoinRoom(name string, password string) error {
+	msg, err := c.request(func(rid int) error {
+		return c.proto.SendJoinRoom(rid, name, password)
+	})
+	if err != nil {
+		return err
 	}
-
-	return res.Code
+	//We joined the room
+	res := msg.(proto.JoinRoomResponse)
+	c.curRoom = res.RoomID
+	c.curChan = -1
+	return nil
 }
 
-//JoinRoom - joins a room. This is a one time per account operation, just to link your account to a room (if you know the name and password). Returns success
-func (c *Client) JoinRoom(name string, password string) bool {
-	err := c.proto.SendJoinRoom(name, password)
-	c.check(err)
-	var res proto.JoinRoomResponse
-	ret := false
-	msg := <-c.channels.joinRoomResponse
-
-	res = msg
-	if res.Code == HTTP_OK {
-		//We joined the room
-		// log.Println("Successfully joined the", name, "room.")
-		ret = true
-		c.curRoom = res.RoomID
-		c.curChan = -1
-	} else if res.Code == HTTP_BADREQUEST {
-		//The room doesn't exist
-		// log.Println("This room doesn't exist (yet):", name)
-	} else if res.Code == HTTP_FORBIDDEN {
-		//bad
-		// log.Println("The password you entered for this room is incorrect, or you were banned from this room")
-	} else {
-		// log.Println("Unknown return code from the server:", res.Code)
+//LeaveRoom - takes us out of a room. The error explains what went wrong, if anything did
+func (c *Client) LeaveRoom(name string) error {
+	_, err := c.request(func(rid int) error {
+		return c.proto.SendLeaveRoom(rid, name)
+	})
+	if err != nil {
+		return err
 	}
+	//we might have been looking at that room, start over with whatever is left
+	c.curRoom = -1
+	c.curChan = -1
+	return nil
+}
 
-	return ret
+//Login - Logs user in. The error explains what went wrong, if anything did
+func (c *Client) Login(username string, password string) error {
+	msg, err := c.request(func(rid int) error {
+		return c.proto.SendLogin(rid, username, password)
+	})
+	if err != nil {
+		return err
+	}
+	return c.loginResult(msg.(proto.LoginResponse), username)
 }
 
-//Login - Logs user in and returns http code
-func (c *Client) Login(username string, password string) bool {
-	err := c.proto.SendLogin(username, password)
-	c.check(err)
-	var ret proto.LoginResponse
-	msg := <-c.channels.loginResponse
-	ret = msg
-	var resp bool
-	if ret.Code == 200 {
-		//Set our proto's session key
-		c.proto.SetKey(ret.Key)
-		c.loggedIn = true
-		resp = true
-	} else {
-		resp = false
+//loginResult - what a LoginResponse means for us, from a password or a two-factor code
+func (c *Client) loginResult(res proto.LoginResponse, username string) error {
+	if res.Code == proto.HTTP_LOCKED {
+		//too many failed logins, for this account or from where we are
+		return proto.Error{Code: res.Code, Reason: proto.ERR_LOCKED, Message: res.Message, Field: proto.FIELD_USERNAME}
+	}
+	if res.Code == proto.HTTP_UNAUTHORIZED {
+		//the password was right, now they need a code
+		c.challenge = res.Challenge
+		c.challengeUser = username
+		return errNeedCode
+	}
+	//Set our proto's session key
+	c.proto.SetKey(res.Key)
+	c.loggedIn.Store(true)
+	if username != "" {
+		c.username = username
 	}
-	return resp
+	return nil
+}
+
+//ChangePassword - swaps our password for a new one. The server logs out every other session we have
+func (c *Client) ChangePassword(oldPassword string, password string) error {
+	_, err := c.request(func(rid int) error {
+		return c.proto.SendChangePassword(rid, oldPassword, password)
+	})
+	return err
+}
+
+//ResetPassword - sets a new password with a reset token from a server admin
+func (c *Client) ResetPassword(token string, password string) error {
+	_, err := c.request(func(rid int) error {
+		return c.proto.SendResetPassword(rid, token, password)
+	})
+	return err
+}
+
+//Resume - hands our session key to the server over a fresh connection
+func (c *Client) Resume() error {
+	_, err := c.request(func(rid int) error {
+		return c.proto.SendResume(rid)
+	})
+	return err
 }
 
 //UpdateRooms - updates the object's rooms struct value by using the return value of GetRooms
 func (c *Client) UpdateRooms() {
-	c.rooms = c.GetRooms()
+	if rooms := c.GetRooms(); rooms != nil {
+		c.mu.Lock()
+		c.rooms = rooms
+		c.mu.Unlock()
+	}
 }
 
 //GetRooms - replaces the list of rooms in the object with what the database says
 func (c *Client) GetRooms() map[int]*proto.Room {
-	err := c.proto.SendGetRoomsRequest()
-	c.check(err)
-	var ret proto.GetRoomsResponse
-	msg := <-c.channels.getRoomsResponse
-	ret = msg
+	msg, err := c.request(func(rid int) error {
+		return c.proto.SendGetRoomsRequest(rid)
+	})
+	ret, ok := msg.(proto.GetRoomsResponse)
+	if err != nil || !ok {
+		return nil
+	}
 	if ret.Code == 200 {
 		//We got a good response...
 		//c.rooms = msg.Rooms
@@ -206,8 +309,8 @@ func (c *Client) GetRooms() map[int]*proto.Room {
 }
 
 //PrintRooms - Nicely prints all the rooms provided
-func (c Client) PrintRooms() {
-	if !c.loggedIn {
+func (c *Client) PrintRooms() {
+	if !c.loggedIn.Load() {
 		fmt.Println("You are not logged in")
 	}
 	for _, v := range c.rooms {
@@ -227,26 +330,64 @@ func (c *Client) sendMessage(msg string, room int, channel int) error {
 		// fmt.Println("Please set your channel and room before sending a message.")
 		return nil
 	}
-	err := c.proto.SendPostMessageRequest(msg, room, channel)
-	c.check(err)
-	var ret proto.PostMessageResponse
-	rmsg := <-c.channels.postMessageResponse
+	_, err := c.request(func(rid int) error {
+		return c.proto.SendPostMessageRequest(rid, msg, room, channel)
+	})
+	return err
+}
 
-	ret = rmsg
-	if ret.Code == 200 {
-		//We got a good response...
-	} else {
-		// log.Println("We got a bad return code...")
+//SlowMode - limits everyone in a channel to one message per interval, for duration. Room admins only, an interval of 0 turns it off
+func (c *Client) SlowMode(room int, channel int, interval time.Duration, duration time.Duration) (proto.SlowModeResponse, error) {
+	msg, err := c.request(func(rid int) error {
+		return c.proto.SendSlowMode(rid, room, channel, interval, duration)
+	})
+	if err != nil {
+		return proto.SlowModeResponse{}, err
 	}
+	return msg.(proto.SlowModeResponse), nil
+}
 
-	return err
+//command - runs a chatbox line that starts with a /. Returns what to put in the status line
+func (c *Client) command(line string) (string, error) {
+	args := strings.Fields(line)
+	switch args[0] {
+	case "/slow":
+		//"/slow 10s 30m" is one message every 10 seconds for the next half an hour, "/slow off" stops it
+		if len(args) == 2 && args[1] == "off" {
+			if _, err := c.SlowMode(c.curRoom, c.curChan, 0, 0); err != nil {
+				return "", err
+			}
+			return "[green]Slow mode is off", nil
+		}
+		if len(args) != 3 {
+			return "", fmt.Errorf("usage: /slow <interval> <duration>, like /slow 10s 30m, or /slow off")
+		}
+		interval, err := time.ParseDuration(args[1])
+		if err != nil {
+			return "", err
+		}
+		duration, err := time.ParseDuration(args[2])
+		if err != nil {
+			return "", err
+		}
+		res, err := c.SlowMode(c.curRoom, c.curChan, interval, duration)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[green]Slow mode is on until %s", c.formatTime(time.Unix(res.Until, 0))), nil
+	}
+	return "", fmt.Errorf("%s isn't a command", args[0])
 }
 
 //UpdateMessages - Queries the database and gets the last N messages from the DB for the channel we are currently on
 func (c *Client) UpdateMessages() {
 	msgs, empty := c.GetMessages(c.curRoom, c.curChan)
 	if !empty {
-		c.rooms[c.curRoom].Channels[c.curChan].Messages = msgs
+		c.mu.Lock()
+		if room, ok := c.rooms[c.curRoom]; ok && room.Channels[c.curChan] != nil {
+			room.Channels[c.curChan].Messages = msgs
+		}
+		c.mu.Unlock()
 	} else {
 		//no messages, don't do anything :-)
 	}
@@ -254,15 +395,24 @@ func (c *Client) UpdateMessages() {
 
 //GetMessages - Queries the database and gets the last N messages from the DB for the channel we are currently on
 func (c *Client) GetMessages(room int, channel int) ([]*proto.Message, bool) {
+	return c.GetMessagesSince(room, channel, 0)
+}
+
+//GetMessagesSince - Queries the database for the messages in a channel newer than the since message id
+func (c *Client) GetMessagesSince(room int, channel int, since int) ([]*proto.Message, bool) {
 	e := true
 	if room == -1 || channel == -1 {
 		// fmt.Println("Please set your channel and room before requesting messages.")
 		empty := make([]*proto.Message, 0)
 		return empty, e
 	}
-	err := c.proto.SendGetMessagesRequest(room, channel)
-	c.check(err)
-	ret := <-c.channels.getMessagesResponse
+	msg, err := c.request(func(rid int) error {
+		return c.proto.SendGetMessagesSinceRequest(rid, room, channel, since)
+	})
+	ret, ok := msg.(proto.GetMessagesResponse)
+	if err != nil || !ok {
+		return make([]*proto.Message, 0), e
+	}
 
 	if ret.Code == 200 {
 		//We got a good response...
@@ -271,8 +421,8 @@ func (c *Client) GetMessages(room int, channel int) ([]*proto.Message, bool) {
 	}
 
 	//see how big our array is
-	if len(ret.Messages) == 0 {
-		e = true
+	if len(ret.Messages) > 0 {
+		e = false
 	}
 
 	return ret.Messages, e
@@ -281,18 +431,29 @@ func (c *Client) GetMessages(room int, channel int) ([]*proto.Message, bool) {
 func (c *Client) populateRoomTree() {
 	root := c.roomtree.GetRoot()
 	for _, v := range c.rooms {
-		node := tview.NewTreeNode(v.DisplayName).SetColor(tcell.ColorGreen)
+		node := tview.NewTreeNode(v.DisplayName).SetColor(c.theme.room)
 		for _, v2 := range v.Channels {
-			node2 := tview.NewTreeNode(v2.Name).SetColor(tcell.ColorGray)
+			node2 := tview.NewTreeNode(v2.Name).SetColor(c.theme.channel)
 			node.AddChild(node2)
 		}
 		root.AddChild(node)
 	}
 }
 
+//formError - shows the user what went wrong under a form, and puts them on the field the server complained about.
+//labels maps proto FIELD_ names to the labels of this form's fields
+func (c *Client) formError(form *tview.Form, errView *tview.TextView, err error, labels map[string]string) {
+	errView.SetText("[red]" + err.Error())
+	if e, ok := err.(proto.Error); ok && labels[e.Field] != "" {
+		c.app.SetFocus(form.GetFormItemByLabel(labels[e.Field]))
+	}
+}
+
 func (c *Client) registerPage() *tview.Grid {
 	form := tview.NewForm()
-	form = form.AddDropDown("Type", []string{"Login", "Register"}, 1, func(option string, index int) {
+	errView := tview.NewTextView().SetDynamicColors(true).SetTextAlign(tview.AlignCenter)
+	labels := map[string]string{proto.FIELD_USERNAME: "Username", proto.FIELD_PASSWORD: "Password"}
+	form = form.AddDropDown("Type", []string{"Login", "Register", "Reset"}, 1, func(option string, index int) {
 		//runs when a selection is made
 		if option == "Register" {
 			//They want to register. Since we're already here, do nothing
@@ -300,6 +461,9 @@ func (c *Client) registerPage() *tview.Grid {
 			//They want to see all things related to logging in. The only way to get here is thru the login page, so lets send them back
 			c.pages.SwitchToPage("login")
 			form.GetFormItemByLabel("Type").(*tview.DropDown).SetCurrentOption(1)
+		} else if option == "Reset" {
+			c.pages.SwitchToPage("reset")
+			form.GetFormItemByLabel("Type").(*tview.DropDown).SetCurrentOption(1)
 		} else {
 			//no idea what they want
 		}
@@ -316,39 +480,88 @@ func (c *Client) registerPage() *tview.Grid {
 			//mismatch
 			pfield.SetText("")
 			verify.SetText("")
-			c.app.SetFocus(ufield)
+			errView.SetText("[red]Passwords do not match")
+			c.app.SetFocus(pfield)
 		} else {
 			//passwords match
-			//send a registration request
-			c.SendRegistration(ufield.GetText(), pfield.GetText())
-			//wait for a registration response
-			resp := <-c.channels.registerResponse
-			if resp.Code == 200 {
+			//send a registration request and wait for the response
+			if err := c.Register(ufield.GetText(), pfield.GetText()); err == nil {
 				//it worked! send them back to the login
+				errView.SetText("")
 				c.pages.SwitchToPage("login")
 			} else {
-				//something went wrong
-				pfield.SetText("")
-				verify.SetText("")
-				c.app.SetFocus(ufield)
+				//something went wrong, tell them what
+				c.formError(form, errView, err, labels)
 			}
 		}
 	})
 	//make the ufield be the default focus
 	form = form.SetFocus(1)
-	grid := tview.NewGrid().SetColumns(0, 20, 0).SetRows(0, 0, 0).AddItem(form, 1, 1, 1, 1, 0, 0, true)
-	grid.SetBorder(true).SetTitle("termtexter").SetTitleAlign(tview.AlignCenter).SetTitleColor(tcell.ColorLimeGreen)
+	grid := tview.NewGrid().SetColumns(0, 20, 0).SetRows(0, 0, 0).AddItem(form, 1, 1, 1, 1, 0, 0, true).
+		AddItem(errView, 2, 0, 1, 3, 0, 0, false)
+	grid.SetBorder(true).SetTitle("termtexter").SetTitleAlign(tview.AlignCenter).SetTitleColor(c.theme.title)
+	return grid
+}
+
+//resetPage - sets a new password with a one-time token from a server admin, for when they can't log in
+func (c *Client) resetPage() *tview.Grid {
+	form := tview.NewForm()
+	errView := tview.NewTextView().SetDynamicColors(true).SetTextAlign(tview.AlignCenter)
+	labels := map[string]string{proto.FIELD_TOKEN: "Token", proto.FIELD_PASSWORD: "Password"}
+	form = form.AddDropDown("Type", []string{"Login", "Register", "Reset"}, 2, func(option string, index int) {
+		//runs when a selection is made
+		if option == "Login" || option == "Register" {
+			c.pages.SwitchToPage(strings.ToLower(option))
+			form.GetFormItemByLabel("Type").(*tview.DropDown).SetCurrentOption(2)
+		}
+	}).AddInputField("Token", "", 32, nil, nil).
+		AddPasswordField("Password", "", 10, '*', nil).
+		AddPasswordField("Verify", "", 10, '*', nil)
+	form = form.AddButton("Reset", func() {
+		tfield := form.GetFormItemByLabel("Token").(*tview.InputField)
+		pfield := form.GetFormItemByLabel("Password").(*tview.InputField)
+		verify := form.GetFormItemByLabel("Verify").(*tview.InputField)
+		//make sure the passwords match
+		if pfield.GetText() != verify.GetText() {
+			pfield.SetText("")
+			verify.SetText("")
+			errView.SetText("[red]Passwords do not match")
+			c.app.SetFocus(pfield)
+			return
+		}
+		if err := c.ResetPassword(tfield.GetText(), pfield.GetText()); err != nil {
+			//something went wrong, tell them what
+			c.formError(form, errView, err, labels)
+			return
+		}
+		//it worked, the token is used up. Send them to log in with the new password
+		tfield.SetText("")
+		pfield.SetText("")
+		verify.SetText("")
+		errView.SetText("")
+		c.pages.SwitchToPage("login")
+	})
+	form = form.SetFocus(1)
+	grid := tview.NewGrid().SetColumns(0, 20, 0).SetRows(0, 0, 0).AddItem(form, 1, 1, 1, 1, 0, 0, true).
+		AddItem(errView, 2, 0, 1, 3, 0, 0, false)
+	grid.SetBorder(true).SetTitle("termtexter").SetTitleAlign(tview.AlignCenter).SetTitleColor(c.theme.title)
 	return grid
 }
 
 func (c *Client) loginPage() *tview.Grid {
 	form := tview.NewForm()
-	form = form.AddDropDown("Type", []string{"Login", "Register"}, 0, func(option string, index int) {
+	errView := tview.NewTextView().SetDynamicColors(true).SetTextAlign(tview.AlignCenter)
+	labels := map[string]string{proto.FIELD_USERNAME: "Username", proto.FIELD_PASSWORD: "Password"}
+	form = form.AddDropDown("Type", []string{"Login", "Register", "Reset"}, 0, func(option string, index int) {
 		//runs when a selection is made
 		if option == "Register" {
 			//They want to register. Let's make that a different "page"
 			c.pages.SwitchToPage("register")
 			form.GetFormItemByLabel("Type").(*tview.DropDown).SetCurrentOption(0)
+		} else if option == "Reset" {
+			//They have a reset token from a server admin
+			c.pages.SwitchToPage("reset")
+			form.GetFormItemByLabel("Type").(*tview.DropDown).SetCurrentOption(0)
 		} else if option == "Login" {
 			//They want to see all things related to logging in. Since we're already here, do nothing
 		} else {
@@ -364,30 +577,34 @@ func (c *Client) loginPage() *tview.Grid {
 		username := ufield.GetText()
 		password := pfield.GetText()
 		//check the login
-		if c.Login(username, password) {
+		if err := c.Login(username, password); err == nil {
+			errView.SetText("")
 			c.pages.SwitchToPage("main")
 			c.refreshClient()
 			c.app.SetFocus(c.chat)
-		} else {
-			//bad credentials, let the user know and blank out their password
-			// ufield.SetText("")
+		} else if err == errNeedCode {
+			//they have two-factor on, ask for the code
+			errView.SetText("")
 			pfield.SetText("")
-			//switch focus up to the ufield
-			c.app.SetFocus(ufield)
+			c.pages.SwitchToPage("twofactor")
+		} else {
+			//bad credentials, let the user know what the server said
+			c.formError(form, errView, err, labels)
 		}
 	})
 	form = form.AddButton("Quit", func() {
 		c.app.Stop()
 	}).AddCheckbox("Remember", false, nil)
-	//default focus
-	form = form.SetFocus(4)
-
-	//TESTING: setting to user
-	form.GetFormItemByLabel("Username").(*tview.InputField).SetText("bill")
-	form.GetFormItemByLabel("Password").(*tview.InputField).SetText("asdf")
+	//start on the username, or the password if the profile already has the username
+	form = form.SetFocus(1)
+	if c.username != "" {
+		form.GetFormItemByLabel("Username").(*tview.InputField).SetText(c.username)
+		form = form.SetFocus(2)
+	}
 
-	grid := tview.NewGrid().SetColumns(0, 20, 0).SetRows(0, 0, 0).AddItem(form, 1, 1, 1, 1, 0, 0, true)
-	grid.SetBorder(true).SetTitle("termtexter").SetTitleAlign(tview.AlignCenter).SetTitleColor(tcell.ColorLimeGreen)
+	grid := tview.NewGrid().SetColumns(0, 20, 0).SetRows(0, 0, 0).AddItem(form, 1, 1, 1, 1, 0, 0, true).
+		AddItem(errView, 2, 0, 1, 3, 0, 0, false)
+	grid.SetBorder(true).SetTitle("termtexter").SetTitleAlign(tview.AlignCenter).SetTitleColor(c.theme.title)
 	return grid
 }
 
@@ -399,22 +616,62 @@ func (c *Client) getMessages() {
 	//data for the chat window
 	c.UpdateMessages()
 	messages := ""
-	for _, v := range c.rooms[c.curRoom].Channels[c.curChan].Messages {
-		messages += c.buildMessage(v.Created.String(), c.rooms[c.curRoom].Users[v.UserID].DisplayName, v.Message)
+	room, ok := c.rooms[c.curRoom]
+	if !ok || room.Channels[c.curChan] == nil {
+		return
+	}
+	for _, v := range room.Channels[c.curChan].Messages {
+		name := fmt.Sprintf("user %d", v.UserID)
+		if u := room.Users[v.UserID]; u != nil {
+			name = u.DisplayName
+		}
+		messages += c.buildMessage(c.formatTime(v.Created), name, v.Message)
 	}
 	c.chat.SetText(strings.Repeat("\n", 1000) + messages)
 }
 
 func (c *Client) getUsers() {
 
-	for _, v := range c.rooms[c.curRoom].Users {
-		c.users.AddItem(v.DisplayName, "", '+', nil)
+	room, ok := c.rooms[c.curRoom]
+	if !ok {
+		return
+	}
+	for _, v := range room.Users {
+		c.users.AddItem(v.DisplayName, "", c.presenceRune(v.ID), nil)
+	}
+}
+
+//presenceRune - the shortcut rune shown next to a user in the user list
+func (c *Client) presenceRune(uid int) rune {
+	if c.offline[uid] {
+		return '-'
+	}
+	return '+'
+}
+
+//presenceHandler - keeps the user list in step with people coming and going
+func (c *Client) presenceHandler() {
+	for {
+		msg := <-c.channels.presence
+		c.app.QueueUpdateDraw(func() {
+			c.offline[msg.UserID] = !msg.Online
+			if c.curRoom == -1 || c.rooms[c.curRoom] == nil {
+				return
+			}
+			c.users.Clear()
+			c.getUsers()
+		})
 	}
 }
 
 func (c *Client) refreshClient() {
 	// defer c.PrintRooms()
 	c.UpdateRooms()
+	if _, ok := c.rooms[c.curRoom]; !ok {
+		//we left the room we were looking at
+		c.curRoom = -1
+		c.curChan = -1
+	}
 	//set our room and channel if we don't have one and there are ones to be a part of
 	if c.curRoom == -1 && len(c.rooms) > 0 {
 		for k := range c.rooms {
@@ -432,6 +689,9 @@ func (c *Client) refreshClient() {
 		}
 	}
 
+	//start the tree and user list over, we might have left a room
+	c.roomtree.GetRoot().ClearChildren()
+	c.users.Clear()
 	if c.curRoom != -1 && c.curChan != -1 {
 		c.UpdateMessages()
 		c.populateRoomTree()
@@ -441,6 +701,7 @@ func (c *Client) refreshClient() {
 
 func (c *Client) joinRoomForm() {
 	form := c.mainmenuform
+	labels := map[string]string{proto.FIELD_ROOM: "Room Name", proto.FIELD_PASSWORD: "Room Password"}
 	form = form.AddInputField("Room Name", "", 10, nil, nil)
 	form = form.AddInputField("Room Password", "", 10, nil, nil).
 		AddButton("Join/Create", func() {
@@ -453,32 +714,25 @@ func (c *Client) joinRoomForm() {
 			rp := rpo.GetText()
 
 			//Do the proper based on the dropdown
+			var err error
 			_, ddStr := form.GetFormItemByLabel("Option").(*tview.DropDown).GetCurrentOption()
 			switch ddStr {
 			case "Join Room":
-				if c.JoinRoom(rn, rp) {
-					//it worked
-					c.refreshClient()
-					c.pages.HidePage("mainmenu")
-					c.app.SetFocus(c.chat)
-				} else {
-					//didn't work, clear the fields
-					rno.SetText("")
-					rpo.SetText("")
-					c.app.SetFocus(form.GetFormItemByLabel("Room Name"))
-				}
+				err = c.JoinRoom(rn, rp)
 			case "Create Room":
-				if c.CreateRoom(rn, rp) == 200 {
-					//it worked
-					c.refreshClient()
-					c.pages.HidePage("mainmenu")
-					c.app.SetFocus(c.chat)
-				} else {
-					//didn't work, clear the fields
-					rno.SetText("")
-					rpo.SetText("")
-					c.app.SetFocus(form.GetFormItemByLabel("Room Name"))
-				}
+				err = c.CreateRoom(rn, rp)
+			case "Leave Room":
+				err = c.LeaveRoom(rn)
+			}
+			if err == nil {
+				//it worked
+				c.mainmenuerr.SetText("")
+				c.refreshClient()
+				c.pages.HidePage("mainmenu")
+				c.app.SetFocus(c.chat)
+			} else {
+				//didn't work, tell them why
+				c.formError(form, c.mainmenuerr, err, labels)
 			}
 
 		}).
@@ -489,21 +743,42 @@ func (c *Client) joinRoomForm() {
 		})
 }
 
-func (c *Client) mainMenu() {
-	modal := func(p tview.Primitive, width, height int) tview.Primitive {
-		return tview.NewFlex().
+//modal - centers p in a width by height box over whatever page is under it
+func modal(p tview.Primitive, width, height int) tview.Primitive {
+	return tview.NewFlex().
+		AddItem(nil, 0, 1, false).
+		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
 			AddItem(nil, 0, 1, false).
-			AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
-				AddItem(nil, 0, 1, false).
-				AddItem(p, height, 1, false).
-				AddItem(nil, 0, 1, false), width, 1, false).
-			AddItem(nil, 0, 1, false)
-	}
-	form := tview.NewForm().
-		AddDropDown("Option", []string{"Join Room", "Create Room"}, 0, nil)
-	form.SetBorder(true).SetTitle("Main Menu").SetTitleAlign(tview.AlignLeft).SetBorderColor(tcell.ColorRed)
+			AddItem(p, height, 1, false).
+			AddItem(nil, 0, 1, false), width, 1, false).
+		AddItem(nil, 0, 1, false)
+}
 
-	m := modal(form, 40, 20)
+func (c *Client) mainMenu() {
+	form := tview.NewForm()
+	options := []string{"Join Room", "Create Room", "Leave Room", "Change Password", "Turn On Two-Factor", "Turn Off Two-Factor"}
+	form = form.AddDropDown("Option", options, 0, func(option string, index int) {
+		switch option {
+		case "Change Password":
+			//that's its own form, swap this one out for it
+			c.pages.HidePage("mainmenu")
+			c.pages.ShowPage("password")
+			c.app.SetFocus(c.passwordform)
+		case "Turn On Two-Factor":
+			c.showTwoFactorSetup()
+		case "Turn Off Two-Factor":
+			c.showTwoFactorOff()
+		default:
+			return
+		}
+		form.GetFormItemByLabel("Option").(*tview.DropDown).SetCurrentOption(0)
+	})
+	form.SetBorder(true).SetTitle("Main Menu").SetTitleAlign(tview.AlignLeft).SetBorderColor(c.theme.focused)
+	c.mainmenuerr = tview.NewTextView().SetDynamicColors(true)
+
+	m := modal(tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(form, 0, 1, true).
+		AddItem(c.mainmenuerr, 2, 0, false), 40, 20)
 	c.pages.AddPage("mainmenu", m, true, false)
 	c.mainmenu = &m
 	c.mainmenuform = form
@@ -511,8 +786,52 @@ func (c *Client) mainMenu() {
 	c.joinRoomForm()
 }
 
+func (c *Client) passwordPage() {
+	form := tview.NewForm()
+	errView := tview.NewTextView().SetDynamicColors(true)
+	labels := map[string]string{proto.FIELD_OLD_PASSWORD: "Current Password", proto.FIELD_PASSWORD: "New Password"}
+	form = form.AddPasswordField("Current Password", "", 20, '*', nil).
+		AddPasswordField("New Password", "", 20, '*', nil).
+		AddPasswordField("Verify", "", 20, '*', nil)
+	done := func() {
+		for _, label := range []string{"Current Password", "New Password", "Verify"} {
+			form.GetFormItemByLabel(label).(*tview.InputField).SetText("")
+		}
+		errView.SetText("")
+		c.pages.HidePage("password")
+		c.app.SetFocus(c.chat)
+	}
+	form = form.AddButton("Change", func() {
+		ofield := form.GetFormItemByLabel("Current Password").(*tview.InputField)
+		pfield := form.GetFormItemByLabel("New Password").(*tview.InputField)
+		verify := form.GetFormItemByLabel("Verify").(*tview.InputField)
+		//make sure the new passwords match
+		if pfield.GetText() != verify.GetText() {
+			pfield.SetText("")
+			verify.SetText("")
+			errView.SetText("[red]Passwords do not match")
+			c.app.SetFocus(pfield)
+			return
+		}
+		if err := c.ChangePassword(ofield.GetText(), pfield.GetText()); err != nil {
+			//something went wrong, tell them what
+			c.formError(form, errView, err, labels)
+			return
+		}
+		done()
+		c.setStatus("[green]Password changed, other sessions were logged out")
+	}).AddButton("Cancel", done)
+	form.SetBorder(true).SetTitle("Change Password").SetTitleAlign(tview.AlignLeft).SetBorderColor(c.theme.focused)
+
+	m := modal(tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(form, 0, 1, true).
+		AddItem(errView, 2, 0, false), 50, 14)
+	c.pages.AddPage("password", m, true, false)
+	c.passwordform = form
+}
+
 func (c *Client) checkIfMainMenu(event *tcell.EventKey) {
-	if event.Key() == tcell.KeyEsc {
+	if event.Key() == c.keys.menu {
 		//bring up the modal menu
 		c.pages.ShowPage("mainmenu")
 		c.app.SetFocus(c.mainmenuform)
@@ -521,7 +840,7 @@ func (c *Client) checkIfMainMenu(event *tcell.EventKey) {
 
 func (c *Client) mainPage() *tview.Flex {
 	//data for the rooms
-	root := tview.NewTreeNode("Rooms").SetColor(tcell.ColorRed)
+	root := tview.NewTreeNode("Rooms").SetColor(c.theme.focused)
 	c.roomtree = tview.NewTreeView().SetRoot(root).SetCurrentNode(root)
 	c.roomtree.SetBorder(true).SetTitle("Rooms")
 
@@ -529,11 +848,17 @@ func (c *Client) mainPage() *tview.Flex {
 	c.chat.SetBorder(true).SetTitle("Chat")
 	//handles new messages that are dynamically sent in
 	go c.messageHandler(c.chat)
+	//handles people coming online and going offline
+	go c.presenceHandler()
 
 	//chatbox
 	chatbox := tview.NewInputField()
 	chatbox.SetBorder(true).SetTitle("Chatbox")
 
+	//connection status
+	c.status = tview.NewTextView().SetDynamicColors(true)
+	c.setStatus("[green]connected")
+
 	//users
 	c.users = tview.NewList()
 	c.users.SetBorder(true).SetTitle("Users")
@@ -544,10 +869,11 @@ func (c *Client) mainPage() *tview.Flex {
 		AddItem(tview.NewFlex().SetDirection(tview.FlexRow).
 			//AddItem(tview.NewBox().SetBorder(true).SetTitle("Top"), 0, 1, false).
 			AddItem(c.chat, 0, 3, false).
-			AddItem(chatbox, 3, 1, false), 0, 2, false).
+			AddItem(chatbox, 3, 1, false).
+			AddItem(c.status, 1, 0, false), 0, 2, false).
 		AddItem(c.users, 20, 1, false)
 
-	c.chat.SetTitleColor(tcell.ColorRed)
+	c.chat.SetTitleColor(c.theme.focused)
 
 	//force a redraw when the textview is updated
 	c.chat.SetChangedFunc(func() {
@@ -557,9 +883,9 @@ func (c *Client) mainPage() *tview.Flex {
 	c.roomtree.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		var ret *tcell.EventKey
 		ret = nil
-		if event.Key() == tcell.KeyRight {
-			c.roomtree.SetTitleColor(tcell.ColorWhite)
-			c.chat.SetTitleColor(tcell.ColorRed)
+		if event.Key() == c.keys.right {
+			c.roomtree.SetTitleColor(c.theme.unfocused)
+			c.chat.SetTitleColor(c.theme.focused)
 			c.app.SetFocus(c.chat)
 		} else {
 			ret = event
@@ -571,23 +897,23 @@ func (c *Client) mainPage() *tview.Flex {
 	c.chat.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		var ret *tcell.EventKey
 		ret = nil
-		if event.Key() == tcell.KeyLeft {
-			c.chat.SetTitleColor(tcell.ColorWhite)
-			c.roomtree.SetTitleColor(tcell.ColorRed)
+		if event.Key() == c.keys.left {
+			c.chat.SetTitleColor(c.theme.unfocused)
+			c.roomtree.SetTitleColor(c.theme.focused)
 			c.app.SetFocus(c.roomtree)
 			ret = event
-		} else if event.Key() == tcell.KeyDown {
-			c.chat.SetTitleColor(tcell.ColorWhite)
-			chatbox.SetTitleColor(tcell.ColorRed)
+		} else if event.Key() == c.keys.down {
+			c.chat.SetTitleColor(c.theme.unfocused)
+			chatbox.SetTitleColor(c.theme.focused)
 			c.app.SetFocus(chatbox)
-		} else if event.Key() == tcell.KeyRight {
-			c.chat.SetTitleColor(tcell.ColorWhite)
-			c.users.SetTitleColor(tcell.ColorRed)
+		} else if event.Key() == c.keys.right {
+			c.chat.SetTitleColor(c.theme.unfocused)
+			c.users.SetTitleColor(c.theme.focused)
 			c.app.SetFocus(c.users)
 			ret = event
-		} else if event.Key() == tcell.KeyPgUp {
+		} else if event.Key() == c.keys.scrollUp {
 			ret = tcell.NewEventKey(tcell.KeyUp, event.Rune(), event.Modifiers())
-		} else if event.Key() == tcell.KeyPgDn {
+		} else if event.Key() == c.keys.scrollDown {
 			ret = tcell.NewEventKey(tcell.KeyDown, event.Rune(), event.Modifiers())
 		}
 		c.checkIfMainMenu(event)
@@ -597,9 +923,9 @@ func (c *Client) mainPage() *tview.Flex {
 	c.users.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		var ret *tcell.EventKey
 		ret = nil
-		if event.Key() == tcell.KeyLeft {
-			c.users.SetTitleColor(tcell.ColorWhite)
-			c.chat.SetTitleColor(tcell.ColorRed)
+		if event.Key() == c.keys.left {
+			c.users.SetTitleColor(c.theme.unfocused)
+			c.chat.SetTitleColor(c.theme.focused)
 			c.app.SetFocus(c.chat)
 		} else {
 			ret = event
@@ -611,16 +937,28 @@ func (c *Client) mainPage() *tview.Flex {
 	chatbox.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		var ret *tcell.EventKey
 		ret = nil
-		if event.Key() == tcell.KeyUp {
-			chatbox.SetTitleColor(tcell.ColorWhite)
-			c.chat.SetTitleColor(tcell.ColorRed)
+		if event.Key() == c.keys.up {
+			chatbox.SetTitleColor(c.theme.unfocused)
+			c.chat.SetTitleColor(c.theme.focused)
 			c.app.SetFocus(c.chat)
 		} else if event.Key() == tcell.KeyEnter {
-			//We want to send a message to the server on an enter
-			err := c.sendMessage(chatbox.GetText(), c.curRoom, c.curChan)
-			c.check(err)
+			//We want to send a message to the server on an enter, unless it's a command
+			var err error
+			if text := chatbox.GetText(); strings.HasPrefix(text, "/") {
+				var status string
+				if status, err = c.command(text); err == nil {
+					c.status.SetText(status)
+				}
+			} else {
+				err = c.sendMessage(text, c.curRoom, c.curChan)
+			}
 			//chat.SetText(chat.GetText(true) + chatbox.GetText() + "\n")
-			chatbox.SetText("")
+			if err == nil {
+				chatbox.SetText("")
+			} else {
+				//leave it in the box so they can try again
+				c.status.SetText("[red]" + err.Error())
+			}
 		} else {
 			ret = event
 		}
@@ -634,46 +972,287 @@ func (c *Client) mainPage() *tview.Flex {
 //packetListener - one go routine that listens on the socket and sends the appropriate object to the appropriate channel
 func (c *Client) packetListener() {
 	for {
-		switch msg := c.proto.Decode().(type) {
+		msg, err := c.proto.Decode()
+		atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+		atomic.StoreInt32(&c.missedPongs, 0)
+		if err != nil && proto.Recoverable(err) {
+			//one bad packet, skip it
+			continue
+		}
+		switch msg := msg.(type) {
 		case proto.GetMessagesResponse:
-			c.channels.getMessagesResponse <- msg
+			c.pending.resolve(msg.RequestID, msg)
 		case proto.GetRoomsResponse:
-			c.channels.getRoomsResponse <- msg
+			c.pending.resolve(msg.RequestID, msg)
 		case proto.JoinRoomResponse:
-			c.channels.joinRoomResponse <- msg
+			c.pending.resolve(msg.RequestID, msg)
 		case proto.RegisterResponse:
-			c.channels.registerResponse <- msg
+			c.pending.resolve(msg.RequestID, msg)
 		case proto.CreateRoomResponse:
-			c.channels.createRoomResponse <- msg
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.LeaveRoomResponse:
+			c.pending.resolve(msg.RequestID, msg)
 		case proto.PostMessageResponse:
-			c.channels.postMessageResponse <- msg
+			c.pending.resolve(msg.RequestID, msg)
 		case proto.LoginResponse:
-			c.channels.loginResponse <- msg
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.ResumeResponse:
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.SlowModeResponse:
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.ChangePasswordResponse:
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.ResetPasswordResponse:
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.TwoFactorSetupResponse:
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.TwoFactorEnableResponse:
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.TwoFactorDisableResponse:
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.HelloResponse:
+			//switch before reading anything else, the next packet is already in the new codec
+			c.proto.SetCodec(msg.Codec)
+			c.proto.SetCompression(msg.Compression)
+			c.pending.resolve(msg.RequestID, msg)
+		case proto.Error:
+			c.pending.resolve(msg.RequestID, msg)
 		case proto.DynamicMessage:
 			c.channels.dynamicMessage <- msg
+		case proto.Presence:
+			c.channels.presence <- msg
+		case proto.GoingAway:
+			//the server is restarting, it'll hang up once it's done with what we already sent
+			atomic.StoreInt64(&c.retryAfter, int64(time.Duration(msg.RetryAfter)*time.Second))
+			c.setStatus("[yellow]" + msg.Reason)
+		case proto.Ping:
+			c.proto.SendPong()
+		case proto.Pong:
+			//nothing to do, hearing from them at all is enough
 		default:
+			if msg == nil {
+				//we lost the server, keep trying until it comes back and then catch up on what we missed
+				c.reconnect()
+				go c.resync()
+			}
 			// log.Println("I don't know what I just got")
 			// log.Println(msg)
 		}
 	}
 }
 
+//setStatus - updates the connection indicator under the chatbox
+func (c *Client) setStatus(status string) {
+	c.app.QueueUpdateDraw(func() {
+		c.status.SetText(status)
+	})
+}
+
+//keepAlive - pings the server when it goes quiet, and drops the connection once it misses too many pongs.
+//Closing the socket makes Decode fail, so the packetListener reconnects like any other disconnect
+func (c *Client) keepAlive() {
+	atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+	for {
+		time.Sleep(PING_INTERVAL)
+		if !c.proto.Has(proto.FEATURE_HEARTBEAT) || time.Since(time.Unix(0, atomic.LoadInt64(&c.lastSeen))) < PING_INTERVAL {
+			continue
+		}
+		if atomic.AddInt32(&c.missedPongs, 1) > MAX_MISSED_PONGS {
+			c.closeConn()
+			continue
+		}
+		c.proto.SendPing()
+	}
+}
+
+//closeConn - hangs up on the server. Decode fails, and the packetListener reconnects
+func (c *Client) closeConn() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Close()
+}
+
+//reconnect - dials the server until it answers, backing off exponentially between attempts
+func (c *Client) reconnect() {
+	c.closeConn()
+	//anything still waiting on a response isn't getting one now
+	c.pending.cancelAll()
+	backoff := MIN_BACKOFF
+	//if the server told us when to come back, don't bother it before then
+	if hint := time.Duration(atomic.SwapInt64(&c.retryAfter, 0)); hint > backoff {
+		backoff = hint
+	}
+	for {
+		c.setStatus("[red]disconnected[white] - retrying in " + backoff.String())
+		time.Sleep(backoff)
+		conn, err := dial(c.addr)
+		if err == nil {
+			c.mu.Lock()
+			c.conn = conn
+			c.proto.Reset(conn)
+			c.mu.Unlock()
+			//give the new connection a fresh heartbeat so keepAlive doesn't drop it straight away
+			atomic.StoreInt64(&c.lastSeen, time.Now().UnixNano())
+			atomic.StoreInt32(&c.missedPongs, 0)
+			break
+		}
+		backoff *= 2
+		if backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+	}
+	c.setStatus("[green]connected")
+}
+
+//resync - puts our session back on the new connection and fetches every message we missed while we were gone
+func (c *Client) resync() {
+	//every new connection starts with a hello
+	if err := c.Hello(); err != nil {
+		c.setStatus("[red]" + err.Error())
+		return
+	}
+	if !c.loggedIn.Load() {
+		//nothing to resume, they're still on the login page
+		return
+	}
+	if (!c.proto.Has(proto.FEATURE_RESUME) || c.Resume() != nil) && (!c.proto.Has(proto.FEATURE_PEERCRED) || c.Login("", "") != nil) {
+		//the server doesn't know our key anymore, send them back to the login page
+		c.loggedIn.Store(false)
+		c.app.QueueUpdateDraw(func() {
+			c.pages.SwitchToPage("login")
+		})
+		return
+	}
+	//rooms may have changed while we were gone, they go in on the UI goroutine before the messages we missed,
+	//which are queued up behind them
+	if rooms := c.GetRooms(); rooms != nil {
+		c.app.QueueUpdateDraw(func() {
+			c.mergeRooms(rooms)
+		})
+	}
+	for rid, channels := range c.lastMessages() {
+		for cid, last := range channels {
+			msgs, empty := c.GetMessagesSince(rid, cid, last)
+			if empty {
+				continue
+			}
+			//feed them through the same path as live messages so they get drawn
+			for _, m := range msgs {
+				dm := proto.DynamicMessage{}
+				dm.Type = proto.DYNAMICMESSAGE
+				dm.Room = rid
+				dm.Channel = cid
+				dm.ID = m.ID
+				dm.UserID = m.UserID
+				dm.Message = m.Message
+				dm.Created = m.Created
+				dm.Received = m.Received
+				c.channels.dynamicMessage <- dm
+			}
+		}
+	}
+}
+
+//lastMessages - the newest message id we have in each channel, by room
+func (c *Client) lastMessages() map[int]map[int]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lasts := make(map[int]map[int]int)
+	for rid, room := range c.rooms {
+		lasts[rid] = make(map[int]int)
+		for cid, channel := range room.Channels {
+			last := 0
+			for _, m := range channel.Messages {
+				if m.ID > last {
+					last = m.ID
+				}
+			}
+			lasts[rid][cid] = last
+		}
+	}
+	return lasts
+}
+
+//mergeRooms - swaps in a fresh list of rooms from the server, keeping the messages we already have.
+//Runs on the UI goroutine
+func (c *Client) mergeRooms(rooms map[int]*proto.Room) {
+	c.mu.Lock()
+	for rid, room := range rooms {
+		old, ok := c.rooms[rid]
+		if !ok {
+			continue
+		}
+		for cid, channel := range room.Channels {
+			if oc, ok := old.Channels[cid]; ok && len(channel.Messages) == 0 {
+				channel.Messages = oc.Messages
+			}
+		}
+	}
+	c.rooms = rooms
+	c.mu.Unlock()
+	if room, ok := rooms[c.curRoom]; !ok || room.Channels[c.curChan] == nil {
+		//the room or channel we were looking at is gone
+		c.curRoom = -1
+		c.curChan = -1
+	}
+	c.roomtree.GetRoot().ClearChildren()
+	c.users.Clear()
+	c.populateRoomTree()
+	if c.curRoom != -1 {
+		c.getUsers()
+	}
+}
+
 func main() {
+	cfg, prof, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	c := new(Client)
 	c.curRoom = -1
 	c.curChan = -1
-	c.Init("localhost", 1200)
+	if err := c.configure(cfg, prof); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad configuration:", err)
+		os.Exit(2)
+	}
+	c.Init(prof.Server)
 
 	register := c.registerPage()
+	reset := c.resetPage()
 	login := c.loginPage()
 	main := c.mainPage()
 	c.pages.AddPage("main", main, true, false)
 	c.pages.AddPage("login", login, true, true)
 	c.pages.AddPage("register", register, true, false)
+	c.pages.AddPage("reset", reset, true, false)
+	twofactor := c.twoFactorPage()
+	c.pages.AddPage("twofactor", twofactor, true, false)
 	//create the main menu modal
 	c.mainMenu()
-	if err := c.app.SetRoot(c.pages, true).SetFocus(login).Run(); err != nil {
+	c.passwordPage()
+	c.twoFactorSetupPage()
+	c.twoFactorOffPage()
+	var focus tview.Primitive = login
+	//on a Unix socket the server may already know who we are
+	if c.proto.Has(proto.FEATURE_PEERCRED) {
+		switch err := c.Login("", ""); err {
+		case nil:
+			c.pages.SwitchToPage("main")
+			c.refreshClient()
+			focus = c.chat
+		case errNeedCode:
+			//being on the right Unix account isn't enough when they have two-factor on
+			c.pages.SwitchToPage("twofactor")
+			focus = twofactor
+		}
+	}
+	if err := c.app.SetRoot(c.pages, true).SetFocus(focus).Run(); err != nil {
 		panic(err)
 	}
 }
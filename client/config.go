@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	proto "termtexter/proto"
+
+	"github.com/BurntSushi/toml"
+	"github.com/gdamore/tcell"
+)
+
+const (
+	DEFAULT_PROFILE = "default"
+)
+
+//Config - the per-user config file, by default termtexter/config.toml in the user's config directory.
+//Flags win over anything in here
+type Config struct {
+	Profile         string             `toml:"profile"`  //the profile to use when -profile isn't given
+	Profiles        map[string]profile `toml:"profiles"` //one per server, by name
+	TimestampFormat string             `toml:"timestamp_format"`
+	Theme           themeConfig        `toml:"theme"`
+	Keys            keysConfig         `toml:"keys"`
+	Notifications   notifyConfig       `toml:"notifications"`
+}
+
+//profile - how to reach one server and who we are there
+type profile struct {
+	Server      string `toml:"server"`   //host:port, tls://host:port, ws:// or wss:// URL, or unix:/path
+	Username    string `toml:"username"` //filled in on the login page
+	Codec       string `toml:"codec"`
+	Compression string `toml:"compression"`
+}
+
+//themeConfig - tcell color names like "red" or "#ff0000"
+type themeConfig struct {
+	Title     string `toml:"title"`     //the border title on the login and register pages
+	Focused   string `toml:"focused"`   //the title of the pane with focus, and the main menu border
+	Unfocused string `toml:"unfocused"` //the titles of the other panes
+	Room      string `toml:"room"`
+	Channel   string `toml:"channel"`
+}
+
+//keysConfig - tcell key names like "Esc", "Left" or "Ctrl-N"
+type keysConfig struct {
+	Menu       string `toml:"menu"`
+	Left       string `toml:"left"` //moving focus between the panes
+	Right      string `toml:"right"`
+	Up         string `toml:"up"`
+	Down       string `toml:"down"`
+	ScrollUp   string `toml:"scroll_up"` //scrolling the chat
+	ScrollDown string `toml:"scroll_down"`
+}
+
+//notifyConfig - what to do when someone else posts a message
+type notifyConfig struct {
+	Bell         bool     `toml:"bell"`          //ring the terminal bell
+	Command      []string `toml:"command"`       //run this with the sender and message tacked on, like ["notify-send", "termtexter"]
+	MentionsOnly bool     `toml:"mentions_only"` //only for messages that have our username in them
+}
+
+//theme - themeConfig turned into colors
+type theme struct {
+	title, focused, unfocused, room, channel tcell.Color
+}
+
+//keys - keysConfig turned into keys
+type keys struct {
+	menu, left, right, up, down, scrollUp, scrollDown tcell.Key
+}
+
+//defaultConfig - the way termtexter looked and behaved before there was a config file
+func defaultConfig() *Config {
+	cfg := &Config{}
+	cfg.Profile = DEFAULT_PROFILE
+	cfg.TimestampFormat = "2006-01-02 15:04:05 -0700 MST"
+	cfg.Theme = themeConfig{Title: "limegreen", Focused: "red", Unfocused: "white", Room: "green", Channel: "gray"}
+	cfg.Keys = keysConfig{Menu: "Esc", Left: "Left", Right: "Right", Up: "Up", Down: "Down", ScrollUp: "PgUp", ScrollDown: "PgDn"}
+	return cfg
+}
+
+//defaultProfile - where to connect when there's no profile for it
+func defaultProfile() profile {
+	return profile{Server: "localhost:1200", Codec: proto.CODEC_JSON}
+}
+
+//configPath - where the config file lives unless -config says otherwise
+func configPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "termtexter", "config.toml")
+}
+
+//loadConfig - reads the config file and picks a profile, with any flags in args on top. Every problem found is in the error
+func loadConfig(args []string) (*Config, profile, error) {
+	cfg := defaultConfig()
+	prof := defaultProfile()
+	fs := flag.NewFlagSet("termtexter", flag.ContinueOnError)
+	path := fs.String("config", configPath(), "config file")
+	name := fs.String("profile", "", "server profile from the config file to use")
+	server := fs.String("server", "", "server to connect to, host:port or tls://host:port for TCP, a ws:// or wss:// URL like ws://localhost:1201/ws, or unix:/path/to/socket")
+	username := fs.String("username", "", "username to fill in on the login page")
+	codec := fs.String("codec", "", "wire codec to ask the server for, "+proto.CODEC_JSON+" or "+proto.CODEC_MSGPACK)
+	compression := fs.String("compression", "", "stream compression to ask the server for, "+proto.COMPRESSION_DEFLATE+" or empty for none")
+	timestamps := fs.String("timestamp-format", "", "Go time layout for message timestamps, like 15:04")
+	if err := fs.Parse(args); err != nil {
+		return nil, prof, err
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	if *path != "" {
+		_, err := toml.DecodeFile(*path, cfg)
+		//not having a config file is fine, unless they asked for one
+		if err != nil && (given["config"] || !errors.Is(err, os.ErrNotExist)) {
+			return nil, prof, fmt.Errorf("config file %s: %w", *path, err)
+		}
+	}
+
+	errs := make([]error, 0)
+	if given["profile"] {
+		cfg.Profile = *name
+	}
+	if p, ok := cfg.Profiles[cfg.Profile]; ok {
+		//anything the profile leaves out stays at the default
+		if p.Server != "" {
+			prof.Server = p.Server
+		}
+		if p.Codec != "" {
+			prof.Codec = p.Codec
+		}
+		prof.Username = p.Username
+		prof.Compression = p.Compression
+	} else if cfg.Profile != DEFAULT_PROFILE {
+		errs = append(errs, fmt.Errorf("profile: there's no profile called %q", cfg.Profile))
+	}
+
+	if given["server"] {
+		prof.Server = *server
+	}
+	if given["username"] {
+		prof.Username = *username
+	}
+	if given["codec"] {
+		prof.Codec = *codec
+	}
+	if given["compression"] {
+		prof.Compression = *compression
+	}
+	if given["timestamp-format"] {
+		cfg.TimestampFormat = *timestamps
+	}
+
+	if prof.Server == "" {
+		errs = append(errs, errors.New("server: can't be empty"))
+	}
+	if prof.Codec != proto.CODEC_JSON && prof.Codec != proto.CODEC_MSGPACK {
+		errs = append(errs, fmt.Errorf("codec: %q isn't %s or %s", prof.Codec, proto.CODEC_JSON, proto.CODEC_MSGPACK))
+	}
+	if prof.Compression != "" && prof.Compression != proto.COMPRESSION_DEFLATE {
+		errs = append(errs, fmt.Errorf("compression: %q isn't %s or empty", prof.Compression, proto.COMPRESSION_DEFLATE))
+	}
+	if cfg.TimestampFormat == "" {
+		errs = append(errs, errors.New("timestamp_format: can't be empty"))
+	}
+	if len(cfg.Notifications.Command) > 0 {
+		if _, err := exec.LookPath(cfg.Notifications.Command[0]); err != nil {
+			errs = append(errs, fmt.Errorf("notifications.command: %w", err))
+		}
+	}
+	_, err := cfg.Theme.parse()
+	errs = append(errs, err)
+	_, err = cfg.Keys.parse()
+	errs = append(errs, err)
+	return cfg, prof, errors.Join(errs...)
+}
+
+//parse - looks up every color in the theme
+func (tc themeConfig) parse() (theme, error) {
+	errs := make([]error, 0)
+	color := func(setting string, name string) tcell.Color {
+		c, ok := tcell.ColorNames[strings.ToLower(name)]
+		if !ok && strings.HasPrefix(name, "#") && len(name) == 7 {
+			c, ok = tcell.GetColor(name), true
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("theme.%s: %q isn't a color", setting, name))
+		}
+		return c
+	}
+	t := theme{
+		title:     color("title", tc.Title),
+		focused:   color("focused", tc.Focused),
+		unfocused: color("unfocused", tc.Unfocused),
+		room:      color("room", tc.Room),
+		channel:   color("channel", tc.Channel),
+	}
+	return t, errors.Join(errs...)
+}
+
+//parse - looks up every key binding
+func (kc keysConfig) parse() (keys, error) {
+	byName := make(map[string]tcell.Key)
+	for k, name := range tcell.KeyNames {
+		byName[strings.ToLower(name)] = k
+	}
+	errs := make([]error, 0)
+	key := func(setting string, name string) tcell.Key {
+		k, ok := byName[strings.ToLower(name)]
+		if !ok {
+			errs = append(errs, fmt.Errorf("keys.%s: %q isn't a key name tcell knows, like Esc, Left or Ctrl-N", setting, name))
+		}
+		return k
+	}
+	k := keys{
+		menu:       key("menu", kc.Menu),
+		left:       key("left", kc.Left),
+		right:      key("right", kc.Right),
+		up:         key("up", kc.Up),
+		down:       key("down", kc.Down),
+		scrollUp:   key("scroll_up", kc.ScrollUp),
+		scrollDown: key("scroll_down", kc.ScrollDown),
+	}
+	return k, errors.Join(errs...)
+}
+
+//configure - sets the client up from a loaded config and profile
+func (c *Client) configure(cfg *Config, prof profile) error {
+	var err error
+	if c.theme, err = cfg.Theme.parse(); err != nil {
+		return err
+	}
+	if c.keys, err = cfg.Keys.parse(); err != nil {
+		return err
+	}
+	c.timestampFormat = cfg.TimestampFormat
+	c.notifications = cfg.Notifications
+	c.username = prof.Username
+	c.Codec = prof.Codec
+	c.Compression = prof.Compression
+	return nil
+}
+
+//notify - lets the user know someone else posted a message, however they asked to be told
+func (c *Client) notify(from string, message string) {
+	n := c.notifications
+	if c.username != "" && from == c.username {
+		return
+	}
+	if n.MentionsOnly && (c.username == "" || !strings.Contains(strings.ToLower(message), strings.ToLower(c.username))) {
+		return
+	}
+	if n.Bell {
+		fmt.Fprint(os.Stdout, "\a")
+	}
+	if len(n.Command) > 0 {
+		cmd := exec.Command(n.Command[0], append(n.Command[1:], from, message)...)
+		if err := cmd.Start(); err == nil {
+			go cmd.Wait()
+		}
+	}
+}
+
+//formatTime - a message timestamp the way the user likes them
+func (c *Client) formatTime(t time.Time) string {
+	return t.Format(c.timestampFormat)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	proto "termtexter/proto"
+	"time"
+)
+
+const (
+	REQUEST_TIMEOUT = 10 * time.Second
+)
+
+var (
+	errTimeout      = errors.New("timed out waiting for the server to respond")
+	errDisconnected = errors.New("lost the connection before the server responded")
+)
+
+//pending - requests we've sent and are still waiting to hear back about, keyed by request id
+type pending struct {
+	mu       sync.Mutex
+	next     int
+	requests map[int]chan interface{}
+}
+
+//add - hands out a new request id and the channel its response will show up on
+func (pr *pending) add() (int, chan interface{}) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.requests == nil {
+		pr.requests = make(map[int]chan interface{})
+	}
+	//ids start at 1, 0 means the packet wasn't a reply to anything
+	pr.next++
+	ch := make(chan interface{}, 1)
+	pr.requests[pr.next] = ch
+	return pr.next, ch
+}
+
+//remove - stops waiting on a request
+func (pr *pending) remove(rid int) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	delete(pr.requests, rid)
+}
+
+//resolve - delivers a response to whoever is waiting on it. Responses nobody is waiting on (anymore) are dropped
+func (pr *pending) resolve(rid int, msg interface{}) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if ch, ok := pr.requests[rid]; ok {
+		ch <- msg
+		delete(pr.requests, rid)
+	}
+}
+
+//cancelAll - the connection went away, so nothing we're waiting on is coming back
+func (pr *pending) cancelAll() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	for rid, ch := range pr.requests {
+		close(ch)
+		delete(pr.requests, rid)
+	}
+}
+
+//request - sends a request with a fresh id and waits for the matching response, giving up after REQUEST_TIMEOUT.
+//Safe to call from as many goroutines as you like
+func (c *Client) request(send func(rid int) error) (interface{}, error) {
+	rid, ch := c.pending.add()
+	if err := send(rid); err != nil {
+		c.pending.remove(rid)
+		return nil, err
+	}
+	select {
+	case msg, ok := <-ch:
+		if !ok {
+			return nil, errDisconnected
+		}
+		//the server turned us down, pass along why
+		if e, ok := msg.(proto.Error); ok {
+			return nil, e
+		}
+		return msg, nil
+	case <-time.After(REQUEST_TIMEOUT):
+		c.pending.remove(rid)
+		return nil, errTimeout
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+
+	proto "termtexter/proto"
+
+	"github.com/coder/websocket"
+)
+
+//dial - connects to the server. Plain host:port addresses are raw TCP, ws:// and wss:// URLs go over WebSocket
+//for networks that only let HTTP(S) out, tls://host:port is TCP with TLS and unix:/path/to/socket is a server on this machine
+func dial(addr string) (net.Conn, error) {
+	//every way in gives up after DIAL_TIMEOUT, or a server that's gone quiet holds up reconnecting for minutes
+	dialer := &net.Dialer{Timeout: DIAL_TIMEOUT}
+	if strings.HasPrefix(addr, "tls://") {
+		return tls.DialWithDialer(dialer, "tcp", strings.TrimPrefix(addr, "tls://"), nil)
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		return dialer.Dial("unix", strings.TrimPrefix(addr, "unix:"))
+	}
+	if !strings.HasPrefix(addr, "ws://") && !strings.HasPrefix(addr, "wss://") {
+		return dialer.Dial("tcp", addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DIAL_TIMEOUT)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	//the server's packets can be as big as a frame, plus whatever compression adds on a bad day
+	ws.SetReadLimit(2 * proto.MAX_FRAME)
+	//every packet is its own binary message, the connection reads them back to back like a stream
+	return websocket.NetConn(context.Background(), ws, websocket.MessageBinary), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/rivo/tview"
+	"github.com/skip2/go-qrcode"
+
+	proto "termtexter/proto"
+)
+
+//errNeedCode - the password (or Unix account) was right, but the account has two-factor on. Finish with TwoFactorLogin
+var errNeedCode = errors.New("enter the code from your authenticator app")
+
+//TwoFactorLogin - the second step of logging in, with a code from the authenticator app or a recovery code
+func (c *Client) TwoFactorLogin(code string) error {
+	msg, err := c.request(func(rid int) error {
+		return c.proto.SendTwoFactorLogin(rid, c.challenge, code)
+	})
+	if err != nil {
+		return err
+	}
+	return c.loginResult(msg.(proto.LoginResponse), c.challengeUser)
+}
+
+//TwoFactorSetup - gets a new secret to put in an authenticator app. Two-factor isn't on until TwoFactorEnable
+func (c *Client) TwoFactorSetup() (proto.TwoFactorSetupResponse, error) {
+	msg, err := c.request(func(rid int) error {
+		return c.proto.SendTwoFactorSetup(rid)
+	})
+	if err != nil {
+		return proto.TwoFactorSetupResponse{}, err
+	}
+	return msg.(proto.TwoFactorSetupResponse), nil
+}
+
+//TwoFactorEnable - turns two-factor on with a code from the new secret. Returns the recovery codes
+func (c *Client) TwoFactorEnable(code string) ([]string, error) {
+	msg, err := c.request(func(rid int) error {
+		return c.proto.SendTwoFactorEnable(rid, code)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msg.(proto.TwoFactorEnableResponse).RecoveryCodes, nil
+}
+
+//TwoFactorDisable - turns two-factor off with a code from the app or a recovery code
+func (c *Client) TwoFactorDisable(code string) error {
+	_, err := c.request(func(rid int) error {
+		return c.proto.SendTwoFactorDisable(rid, code)
+	})
+	return err
+}
+
+//qrCode - a QR code for the terminal, two rows to a line
+func qrCode(text string) (string, error) {
+	qr, err := qrcode.New(text, qrcode.Low)
+	if err != nil {
+		return "", err
+	}
+	return qr.ToSmallString(false), nil
+}
+
+//twoFactorPage - the second step of logging in, after the password was accepted
+func (c *Client) twoFactorPage() *tview.Grid {
+	form := tview.NewForm()
+	errView := tview.NewTextView().SetDynamicColors(true).SetTextAlign(tview.AlignCenter)
+	labels := map[string]string{proto.FIELD_CODE: "Code"}
+	form = form.AddInputField("Code", "", 11, nil, nil)
+	form = form.AddButton("Verify", func() {
+		cfield := form.GetFormItemByLabel("Code").(*tview.InputField)
+		err := c.TwoFactorLogin(cfield.GetText())
+		cfield.SetText("")
+		if err != nil {
+			c.formError(form, errView, err, labels)
+			return
+		}
+		errView.SetText("")
+		c.pages.SwitchToPage("main")
+		c.refreshClient()
+		c.app.SetFocus(c.chat)
+	}).AddButton("Back", func() {
+		errView.SetText("")
+		c.pages.SwitchToPage("login")
+	})
+	hint := tview.NewTextView().SetTextAlign(tview.AlignCenter).
+		SetText("Enter the code from your authenticator app, or one of your recovery codes")
+	grid := tview.NewGrid().SetColumns(0, 20, 0).SetRows(0, 0, 0).AddItem(hint, 0, 0, 1, 3, 0, 0, false).
+		AddItem(form, 1, 1, 1, 1, 0, 0, true).
+		AddItem(errView, 2, 0, 1, 3, 0, 0, false)
+	grid.SetBorder(true).SetTitle("termtexter").SetTitleAlign(tview.AlignCenter).SetTitleColor(c.theme.title)
+	return grid
+}
+
+//twoFactorSetupPage - the modal that shows a new secret as a QR code, and then the recovery codes
+func (c *Client) twoFactorSetupPage() {
+	c.twofactorview = tview.NewTextView().SetDynamicColors(true).SetTextAlign(tview.AlignCenter)
+	c.twofactorform = tview.NewForm()
+	c.twofactorform.SetBorder(true).SetTitle("Two-Factor").SetTitleAlign(tview.AlignLeft).SetBorderColor(c.theme.focused)
+	m := modal(tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(c.twofactorview, 0, 1, false).
+		AddItem(c.twofactorform, 7, 0, true), 70, 45)
+	c.pages.AddPage("twofactor-setup", m, true, false)
+}
+
+//showTwoFactorSetup - asks for a new secret and walks them through turning two-factor on
+func (c *Client) showTwoFactorSetup() {
+	setup, err := c.TwoFactorSetup()
+	if err != nil {
+		c.mainmenuerr.SetText("[red]" + err.Error())
+		return
+	}
+	qr, err := qrCode(setup.URI)
+	if err != nil {
+		c.mainmenuerr.SetText("[red]" + err.Error())
+		return
+	}
+	c.mainmenuerr.SetText("")
+	view := c.twofactorview
+	intro := "Scan this with your authenticator app\n\n" + qr +
+		"\nor enter the key by hand: " + setup.Secret + "\n\nthen type the code it shows to turn two-factor on"
+	view.SetText(intro)
+	done := func() {
+		view.SetText("")
+		c.pages.HidePage("twofactor-setup")
+		c.app.SetFocus(c.chat)
+	}
+	form := c.twofactorform.Clear(true)
+	form.AddInputField("Code", "", 8, nil, nil).
+		AddButton("Turn On", func() {
+			cfield := form.GetFormItemByLabel("Code").(*tview.InputField)
+			codes, err := c.TwoFactorEnable(cfield.GetText())
+			cfield.SetText("")
+			if err != nil {
+				view.SetText("[red]" + err.Error() + "[-]\n\n" + intro)
+				return
+			}
+			//these are only shown this once, so they have to write them down now
+			view.SetText("[green]Two-factor is on.[-]\n\nKeep these recovery codes somewhere safe. Each one logs you in once " +
+				"without your phone, and you won't see them again:\n\n" + strings.Join(codes, "\n"))
+			form.Clear(true).AddButton("Done", done)
+			c.app.SetFocus(form)
+		}).
+		AddButton("Cancel", done)
+	c.pages.HidePage("mainmenu")
+	c.pages.ShowPage("twofactor-setup")
+	c.app.SetFocus(form)
+}
+
+//twoFactorOffPage - the modal that turns two-factor off
+func (c *Client) twoFactorOffPage() {
+	form := tview.NewForm()
+	errView := tview.NewTextView().SetDynamicColors(true)
+	labels := map[string]string{proto.FIELD_CODE: "Code"}
+	done := func() {
+		form.GetFormItemByLabel("Code").(*tview.InputField).SetText("")
+		errView.SetText("")
+		c.pages.HidePage("twofactor-off")
+		c.app.SetFocus(c.chat)
+	}
+	form = form.AddInputField("Code", "", 11, nil, nil).
+		AddButton("Turn Off", func() {
+			if err := c.TwoFactorDisable(form.GetFormItemByLabel("Code").(*tview.InputField).GetText()); err != nil {
+				c.formError(form, errView, err, labels)
+				return
+			}
+			done()
+			c.setStatus("[green]Two-factor is off")
+		}).
+		AddButton("Cancel", done)
+	form.SetBorder(true).SetTitle("Turn Off Two-Factor").SetTitleAlign(tview.AlignLeft).SetBorderColor(c.theme.focused)
+	m := modal(tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(form, 0, 1, true).
+		AddItem(errView, 2, 0, false), 50, 10)
+	c.pages.AddPage("twofactor-off", m, true, false)
+	c.twofactoroff = form
+}
+
+//showTwoFactorOff - brings up the modal that turns two-factor off
+func (c *Client) showTwoFactorOff() {
+	c.pages.HidePage("mainmenu")
+	c.pages.ShowPage("twofactor-off")
+	c.app.SetFocus(c.twofactoroff)
+}
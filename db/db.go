@@ -1,9 +1,10 @@
 package termtexterdb
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
-	"log"
+	"errors"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -21,209 +22,626 @@ type User struct {
 	Password    string
 }
 
+//LoginAttempts - failed logins in a row for a user, so the server can slow down password guessing
+type LoginAttempts struct {
+	Failures    int       //since the last good login or lockout
+	Last        time.Time //the latest failure
+	LockedUntil time.Time //zero if they aren't locked out
+}
+
 //DB is an object that will abstract the db stuff into nice methods
 type DB struct {
-	dbh *sql.DB
+	dbh             *sql.DB
+	SessionLifetime time.Duration //how long a session key works after login, 0 for forever
+	//Observe - if set, told how long each call took, named like "get_user_id"
+	Observe func(query string, took time.Duration)
+	//BcryptCost - how hard password hashes are to crack (and make), bcrypt.DefaultCost if it's 0.
+	//Hashes made with less are redone the next time the password is checked
+	BcryptCost int
+}
+
+//cost - the bcrypt cost for new hashes
+func (d DB) cost() int {
+	if d.BcryptCost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return d.BcryptCost
+}
+
+//ErrNotFound - there's no such user or session. The caller decides what that means to the client
+var ErrNotFound = errors.New("termtexterdb: not found")
+
+//notFound - turns sql.ErrNoRows into ErrNotFound, so callers don't need to know about database/sql
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	return err
 }
 
-func check(e error) {
-	if e != nil {
-		panic(e)
+//observe - tells Observe how long a call took. Use as defer d.observe("name", time.Now())
+func (d DB) observe(query string, start time.Time) {
+	if d.Observe != nil {
+		d.Observe(query, time.Since(start))
 	}
 }
 
-//Connect gets the user record from the database
-func (d *DB) Connect(hostname string, password string) error {
+//Connect opens the database with the given driver and DSN, and makes sure it's actually there
+func (d *DB) Connect(backend string, dsn string) error {
 	// connect to the database
 	var err error
-	d.dbh, err = sql.Open("mysql", "termtexter:"+password+"@tcp("+hostname+")/termtexter?parseTime=true&loc=America%2FNew_York")
-	return err
+	d.dbh, err = sql.Open(backend, dsn)
+	if err != nil {
+		return err
+	}
+	return d.dbh.Ping()
+}
+
+//Ping checks the database is still there, for health checks
+func (d *DB) Ping(ctx context.Context) error {
+	defer d.observe("ping", time.Now())
+	if d.dbh == nil {
+		return errors.New("termtexterdb: not connected")
+	}
+	return d.dbh.PingContext(ctx)
+}
+
+//Close closes the database once everyone is done with it
+func (d *DB) Close() error {
+	if d.dbh == nil {
+		return nil
+	}
+	return d.dbh.Close()
 }
 
 //GetUserIDFromKey - given a login session key, get the userID associated with it
 func (d DB) GetUserIDFromKey(key string) (string, error) {
-	rows, err := d.dbh.Query("select u.user_id from users u join sessions s on u.user_id = s.user_id where `key` = ?", key)
-	check(err)
-	defer rows.Close()
-	rows.Next()
+	defer d.observe("get_user_id_from_key", time.Now())
+	//sessions older than SessionLifetime don't count
+	lifetime := int64(d.SessionLifetime / time.Second)
 	var u string
-	err = rows.Scan(&u)
-	return u, err
+	err := d.dbh.QueryRow("select u.user_id from users u join sessions s on u.user_id = s.user_id where `key` = ? "+
+		"and (? = 0 or timestampdiff(second, s.created, current_timestamp()) < ?)", key, lifetime, lifetime).Scan(&u)
+	return u, notFound(err)
 }
 
-//DoesRoomExist - returns the room number if it exists
+//DoesRoomExist - returns the room number if it exists, -1 if it doesn't
 func (d DB) DoesRoomExist(rid string) (int, error) {
-	rows, err := d.dbh.Query("select room_id from rooms where name = ?", rid)
-	check(err)
-	defer rows.Close()
+	defer d.observe("does_room_exist", time.Now())
 	i := -1
-	rows.Next()
-	err = rows.Scan(&i)
+	err := d.dbh.QueryRow("select room_id from rooms where name = ?", rid).Scan(&i)
+	if errors.Is(err, sql.ErrNoRows) {
+		return -1, nil
+	}
 	return i, err
 }
 
 //PostMessage -
 func (d *DB) PostMessage(id string, pm proto.PostMessageRequest) (int64, error) {
+	defer d.observe("post_message", time.Now())
 	v, err := d.dbh.Exec("insert into messages (user_id,channel_id,message) values (?,?,?)", id, pm.Channel, pm.Message)
-	check(err)
-	i, err := v.LastInsertId()
-	return i, err
+	if err != nil {
+		return 0, err
+	}
+	return v.LastInsertId()
 }
 
-//GetMessages -
-func (d DB) GetMessages(room int, channel int) ([]*proto.Message, error) {
+//GetMessages - gets the messages in a channel with an id greater than since (0 for all of them)
+func (d DB) GetMessages(room int, channel int, since int) ([]*proto.Message, error) {
+	defer d.observe("get_messages", time.Now())
 	rows, err := d.dbh.Query(`select m.message_id, m.user_id, m.message, m.created, m.received from messages m join channels c
-	on m.channel_id = c.channel_id join rooms r on r.room_id = c.room_id where r.room_id = ? and c.channel_id = ? order by m.created`, room, channel)
-	check(err)
+	on m.channel_id = c.channel_id join rooms r on r.room_id = c.room_id where r.room_id = ? and c.channel_id = ? and m.message_id > ? order by m.created`, room, channel, since)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	messages := make([]*proto.Message, 0)
 	for rows.Next() {
 		message := proto.Message{}
-		rows.Scan(&message.ID, &message.UserID, &message.Message, &message.Created, &message.Received)
+		if err := rows.Scan(&message.ID, &message.UserID, &message.Message, &message.Created, &message.Received); err != nil {
+			return nil, err
+		}
 		messages = append(messages, &message)
-		log.Println(message)
 	}
 
-	return messages, err
+	return messages, rows.Err()
 }
 
-//GetRooms -
+//GetRooms - gets every room a user is in, along with their channels and users
 func (d DB) GetRooms(uid string) (map[int]*proto.Room, error) {
+	defer d.observe("get_rooms", time.Now())
 	rows, err := d.dbh.Query(`select r.room_id, r.name, r.displayname from rooms r join room_users ru on r.room_id = ru.room_id 
 	join users u on u.user_id = ru.user_id where u.user_id = ?`, uid)
-	check(err)
-	defer rows.Close()
+	if err != nil {
+		return nil, err
+	}
 	rooms := make(map[int]*proto.Room)
 
 	for rows.Next() {
 		room := proto.Room{}
-		rows.Scan(&room.ID, &room.Name, &room.DisplayName)
+		if err := rows.Scan(&room.ID, &room.Name, &room.DisplayName); err != nil {
+			rows.Close()
+			return nil, err
+		}
 		rooms[room.ID] = &room
 	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
 	for k := range rooms {
+		err = d.fillRoom(rooms[k])
+		if err != nil {
+			return rooms, err
+		}
+	}
 
-		//Channels
-		rows, err = d.dbh.Query("select c.channel_id, c.name from channels c join rooms r on c.room_id = r.room_id where c.room_id = ?", k)
-		check(err)
-		for rows.Next() {
-			channel := proto.Channel{}
-			rows.Scan(&channel.ID, &channel.Name)
-			rooms[k].Channels = make(map[int]*proto.Channel)
-			rooms[k].Channels[channel.ID] = &channel
+	return rooms, err
+}
+
+//GetRoom - gets a single room along with its channels and users
+func (d DB) GetRoom(rid int) (*proto.Room, error) {
+	defer d.observe("get_room", time.Now())
+	room := proto.Room{}
+	err := d.dbh.QueryRow("select room_id, name, displayname from rooms where room_id = ?", rid).Scan(&room.ID, &room.Name, &room.DisplayName)
+	if err != nil {
+		return nil, err
+	}
+	err = d.fillRoom(&room)
+	return &room, err
+}
+
+//fillRoom - loads the channels and users of a room
+func (d DB) fillRoom(room *proto.Room) error {
+	//Channels
+	rows, err := d.dbh.Query("select c.channel_id, c.name from channels c join rooms r on c.room_id = r.room_id where c.room_id = ?", room.ID)
+	if err != nil {
+		return err
+	}
+	room.Channels = make(map[int]*proto.Channel)
+	for rows.Next() {
+		channel := proto.Channel{}
+		if err := rows.Scan(&channel.ID, &channel.Name); err != nil {
+			rows.Close()
+			return err
 		}
+		room.Channels[channel.ID] = &channel
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
 
-		//Users
-		rows, err = d.dbh.Query("select u.user_id,u.username,u.created,u.displayname from users u join room_users ru on u.user_id = ru.user_id join rooms r on ru.room_id = r.room_id where r.room_id = ?", k)
-		check(err)
-		for rows.Next() {
-			user := proto.User{}
-			rows.Scan(&user.ID, &user.UserName, &user.Created, &user.DisplayName)
-			rooms[k].Users = make(map[int]*proto.User)
-			rooms[k].Users[user.ID] = &user
+	//Users
+	rows, err = d.dbh.Query("select u.user_id,u.username,u.created,u.displayname from users u join room_users ru on u.user_id = ru.user_id join rooms r on ru.room_id = r.room_id where r.room_id = ?", room.ID)
+	if err != nil {
+		return err
+	}
+	room.Users = make(map[int]*proto.User)
+	for rows.Next() {
+		user := proto.User{}
+		if err := rows.Scan(&user.ID, &user.UserName, &user.Created, &user.DisplayName); err != nil {
+			rows.Close()
+			return err
 		}
+		room.Users[user.ID] = &user
 	}
+	rows.Close()
+	return rows.Err()
+}
 
-	return rooms, err
+//IsRoomAdmin - whether the user is an admin of the room. Not being in the room at all isn't an error, just not an admin
+func (d DB) IsRoomAdmin(uid string, rid int) (bool, error) {
+	defer d.observe("is_room_admin", time.Now())
+	var admin bool
+	err := d.dbh.QueryRow("select admin from room_users where room_id = ? and user_id = ?", rid, uid).Scan(&admin)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return admin, err
 }
 
 //AddUserToRoom - given an id, add this id into the mapping table
 func (d DB) AddUserToRoom(uid string, rid int) error {
+	defer d.observe("add_user_to_room", time.Now())
 	_, err := d.dbh.Exec("insert into room_users (room_id,user_id) values (?,?)", rid, uid)
 	return err
 }
 
-//CreateRoom - Create a room, set user as admin, and build a default first channel
-func (d DB) CreateRoom(rid string, uid string, password string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+//RemoveUserFromRoom - given an id, take this id out of the mapping table
+func (d DB) RemoveUserFromRoom(uid string, rid int) error {
+	defer d.observe("remove_user_from_room", time.Now())
+	_, err := d.dbh.Exec("delete from room_users where room_id = ? and user_id = ?", rid, uid)
+	return err
+}
+
+//CreateRoom - Create a room, set user as admin, and build a default first channel. Returns the new room's id
+func (d DB) CreateRoom(rid string, uid string, password string) (int, error) {
+	defer d.observe("create_room", time.Now())
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), d.cost())
+	if err != nil {
+		return -1, err
+	}
 	//Handle this as a transaction since we're doing a few changes here
 	t, err := d.dbh.Begin()
+	if err != nil {
+		return -1, err
+	}
+	//rolling back after a commit does nothing, so this only undoes a half-made room
 	defer t.Rollback()
 	//Start by creating the room
 	res, err := t.Exec("insert into rooms (name,password) values (?,?)", rid, hash)
-	check(err)
+	if err != nil {
+		return -1, err
+	}
 	dbRoomID, err := res.LastInsertId()
-	check(err)
+	if err != nil {
+		return -1, err
+	}
 	//Add the requesting user to this room as an admin
-	res, err = t.Exec("insert into room_users (room_id,user_id,admin) values (?,?,?)", dbRoomID, uid, 1)
-	check(err)
+	if _, err := t.Exec("insert into room_users (room_id,user_id,admin) values (?,?,?)", dbRoomID, uid, 1); err != nil {
+		return -1, err
+	}
 	//Create a channel for this room, with the name of "general"
-	res, err = t.Exec("insert into channels (room_id,name) values (?,?)", dbRoomID, "general")
-	check(err)
-	fmt.Println(res)
-	t.Commit()
-	return err
+	if _, err := t.Exec("insert into channels (room_id,name) values (?,?)", dbRoomID, "general"); err != nil {
+		return -1, err
+	}
+	return int(dbRoomID), t.Commit()
 }
 
 //GetUserID gets the user id from the database if it exists
 func (d DB) GetUserID(username string) (string, error) {
-	rows, err := d.dbh.Query("select user_id from users where username = ?", username)
-	check(err)
-	defer rows.Close()
-	rows.Next()
+	defer d.observe("get_user_id", time.Now())
 	var u string
-	err = rows.Scan(&u)
-	return u, err
+	err := d.dbh.QueryRow("select user_id from users where username = ?", username).Scan(&u)
+	return u, notFound(err)
 }
 
 //GetUser gets the user record from the database
 func (d DB) GetUser(username string) (User, error) {
-	rows, err := d.dbh.Query("select user_id, username, displayname, password from users where username = ?", username)
-	check(err)
-	defer rows.Close()
-	rows.Next()
+	defer d.observe("get_user", time.Now())
 	var u User
-	err = rows.Scan(&u.UserID, &u.Username, &u.Displayname, &u.Password)
-	return u, err
+	err := d.dbh.QueryRow("select user_id, username, displayname, password from users where username = ?", username).
+		Scan(&u.UserID, &u.Username, &u.Displayname, &u.Password)
+	return u, notFound(err)
 }
 
 //Register - Register's a new user
 func (d DB) Register(username string, password string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	defer d.observe("register", time.Now())
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), d.cost())
+	if err != nil {
+		return err
+	}
 	_, err = d.dbh.Exec("insert into users (username,password) values (?,?)", username, string(hash))
 	return err
 }
 
 //UserExists will return a bool if the user is registered
 func (d DB) UserExists(username string) (bool, error) {
-	rows, err := d.dbh.Query("select 1 from users where username = ?", username)
-	check(err)
-	defer rows.Close()
-	c := 0
+	defer d.observe("user_exists", time.Now())
+	var one int
+	err := d.dbh.QueryRow("select 1 from users where username = ?", username).Scan(&one)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//IsValidLogin will determine if the login was valid. Pass in a plain text password. An unknown user is just not valid
+func (d DB) IsValidLogin(uid string, password string) (bool, error) {
+	defer d.observe("is_valid_login", time.Now())
+	var epassword string
+	err := d.dbh.QueryRow("select password from users where user_id = ?", uid).Scan(&epassword)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(epassword), []byte(password)) != nil {
+		return false, nil
+	}
+	//this is the only time we have the password, so bring an old weak hash up to the current cost now
+	if cost, err := bcrypt.Cost([]byte(epassword)); err == nil && cost < d.cost() {
+		//if it doesn't work it'll be tried again next login, the password was still right
+		if hash, err := bcrypt.GenerateFromPassword([]byte(password), d.cost()); err == nil {
+			d.dbh.Exec("update users set password = ? where user_id = ?", string(hash), uid)
+		}
+	}
+	return true, nil
+}
+
+//ChangePassword - sets a new password and logs out every session but keepKey, so a stolen session doesn't outlive it
+func (d DB) ChangePassword(uid string, password string, keepKey string) error {
+	defer d.observe("change_password", time.Now())
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), d.cost())
+	if err != nil {
+		return err
+	}
+	t, err := d.dbh.Begin()
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	if _, err := t.Exec("update users set password = ? where user_id = ?", string(hash), uid); err != nil {
+		return err
+	}
+	if _, err := t.Exec("delete from sessions where user_id = ? and `key` <> ?", uid, keepKey); err != nil {
+		return err
+	}
+	return t.Commit()
+}
+
+//GetUsername - the username for a user id
+func (d DB) GetUsername(uid string) (string, error) {
+	defer d.observe("get_username", time.Now())
+	var u string
+	err := d.dbh.QueryRow("select username from users where user_id = ?", uid).Scan(&u)
+	return u, notFound(err)
+}
+
+//GetLoginAttempts - the failed logins for a user
+func (d DB) GetLoginAttempts(uid string) (LoginAttempts, error) {
+	defer d.observe("get_login_attempts", time.Now())
+	var a LoginAttempts
+	var last, locked sql.NullTime
+	err := d.dbh.QueryRow("select failed_logins, last_failed_login, locked_until from users where user_id = ?", uid).
+		Scan(&a.Failures, &last, &locked)
+	a.Last = last.Time
+	a.LockedUntil = locked.Time
+	return a, notFound(err)
+}
+
+//SetLoginAttempts - saves the failed logins for a user, the zero value clears them
+func (d DB) SetLoginAttempts(uid string, a LoginAttempts) error {
+	defer d.observe("set_login_attempts", time.Now())
+	last := sql.NullTime{Time: a.Last, Valid: !a.Last.IsZero()}
+	locked := sql.NullTime{Time: a.LockedUntil, Valid: !a.LockedUntil.IsZero()}
+	_, err := d.dbh.Exec("update users set failed_logins = ?, last_failed_login = ?, locked_until = ? where user_id = ?",
+		a.Failures, last, locked, uid)
+	return err
+}
+
+//AddFailedLogin - counts one more failed login for a user, locking them out until lockedUntil if that makes
+//lockoutAt in a row (0 never locks). The count is bumped in the database and the lockout decided on what it
+//comes to, so failures at the same time all count. Returns what the user is up to
+func (d DB) AddFailedLogin(uid string, now time.Time, lockoutAt int, lockedUntil time.Time) (LoginAttempts, error) {
+	defer d.observe("add_failed_login", time.Now())
+	t, err := d.dbh.Begin()
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	defer t.Rollback()
+	res, err := t.Exec("update users set failed_logins = failed_logins + 1, last_failed_login = ? where user_id = ?", now, uid)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return LoginAttempts{}, err
+	} else if n == 0 {
+		return LoginAttempts{}, ErrNotFound
+	}
+	//the update holds the row until we commit, so nobody else can bump it in between
+	a := LoginAttempts{Last: now}
+	var locked sql.NullTime
+	err = t.QueryRow("select failed_logins, locked_until from users where user_id = ?", uid).Scan(&a.Failures, &locked)
+	if err != nil {
+		return LoginAttempts{}, err
+	}
+	a.LockedUntil = locked.Time
+	if lockoutAt > 0 && a.Failures >= lockoutAt {
+		if _, err := t.Exec("update users set failed_logins = 0, locked_until = ? where user_id = ?", lockedUntil, uid); err != nil {
+			return LoginAttempts{}, err
+		}
+		a.Failures = 0
+		a.LockedUntil = lockedUntil
+	}
+	return a, t.Commit()
+}
+
+//UnlockUser - clears a user's failed logins and any lockout, for an admin
+func (d DB) UnlockUser(username string) error {
+	defer d.observe("unlock_user", time.Now())
+	res, err := d.dbh.Exec("update users set failed_logins = 0, last_failed_login = null, locked_until = null where username = ?", username)
+	if err != nil {
+		return err
+	}
+	//an update that changes nothing still finds the row, so check it's there
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		if exists, err := d.UserExists(username); err != nil {
+			return err
+		} else if !exists {
+			return ErrNotFound
+		}
+	}
+	return nil
+}
+
+//SetResetToken - gives a user a password reset token, replacing any they already had. Only the hash is stored,
+//so someone reading the database can't use it
+func (d DB) SetResetToken(username string, tokenHash string, expires time.Time) error {
+	defer d.observe("set_reset_token", time.Now())
+	res, err := d.dbh.Exec("update users set reset_token = ?, reset_expires = ? where username = ?", tokenHash, expires, username)
+	if err != nil {
+		return err
+	}
+	//every token is new, so nothing changing means there's no such user
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+//GetResetToken - the user id a reset token belongs to, ErrNotFound if it's wrong or expired
+func (d DB) GetResetToken(tokenHash string) (string, error) {
+	defer d.observe("get_reset_token", time.Now())
+	var uid string
+	err := d.dbh.QueryRow("select user_id from users where reset_token = ? and reset_expires > ?", tokenHash, time.Now()).Scan(&uid)
+	return uid, notFound(err)
+}
+
+//ResetPassword - uses up a reset token to set a new password. It also lifts any lockout and logs out every session,
+//whoever had them. ErrNotFound if the token was used or expired in the meantime
+func (d DB) ResetPassword(uid string, tokenHash string, password string) error {
+	defer d.observe("reset_password", time.Now())
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), d.cost())
+	if err != nil {
+		return err
+	}
+	t, err := d.dbh.Begin()
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	res, err := t.Exec("update users set password = ?, reset_token = null, reset_expires = null, failed_logins = 0, "+
+		"last_failed_login = null, locked_until = null where user_id = ? and reset_token = ? and reset_expires > ?",
+		string(hash), uid, tokenHash, time.Now())
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	if _, err := t.Exec("delete from sessions where user_id = ?", uid); err != nil {
+		return err
+	}
+	return t.Commit()
+}
+
+//GetTwoFactor - a user's TOTP secret, and whether it's turned on or only waiting to be confirmed
+func (d DB) GetTwoFactor(uid string) (secret string, enabled bool, err error) {
+	defer d.observe("get_two_factor", time.Now())
+	var s sql.NullString
+	err = d.dbh.QueryRow("select totp_secret, totp_enabled from users where user_id = ?", uid).Scan(&s, &enabled)
+	return s.String, enabled, notFound(err)
+}
+
+//SetTwoFactorSecret - stores a new TOTP secret that doesn't count until EnableTwoFactor
+func (d DB) SetTwoFactorSecret(uid string, secret string) error {
+	defer d.observe("set_two_factor_secret", time.Now())
+	_, err := d.dbh.Exec("update users set totp_secret = ?, totp_enabled = 0 where user_id = ?", secret, uid)
+	return err
+}
+
+//EnableTwoFactor - turns on the secret from SetTwoFactorSecret, with a fresh set of recovery codes.
+//Only bcrypt hashes of the codes are stored, the same as passwords
+func (d DB) EnableTwoFactor(uid string, codes []string) error {
+	defer d.observe("enable_two_factor", time.Now())
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), d.cost())
+		if err != nil {
+			return err
+		}
+		hashes[i] = string(hash)
+	}
+	t, err := d.dbh.Begin()
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	if _, err := t.Exec("update users set totp_enabled = 1 where user_id = ? and totp_secret is not null", uid); err != nil {
+		return err
+	}
+	if _, err := t.Exec("delete from recovery_codes where user_id = ?", uid); err != nil {
+		return err
+	}
+	for _, h := range hashes {
+		if _, err := t.Exec("insert into recovery_codes (user_id, code) values (?,?)", uid, h); err != nil {
+			return err
+		}
+	}
+	return t.Commit()
+}
+
+//DisableTwoFactor - forgets a user's TOTP secret and recovery codes
+func (d DB) DisableTwoFactor(uid string) error {
+	defer d.observe("disable_two_factor", time.Now())
+	t, err := d.dbh.Begin()
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	if _, err := t.Exec("update users set totp_secret = null, totp_enabled = 0 where user_id = ?", uid); err != nil {
+		return err
+	}
+	if _, err := t.Exec("delete from recovery_codes where user_id = ?", uid); err != nil {
+		return err
+	}
+	return t.Commit()
+}
+
+//UseRecoveryCode - uses up one of a user's recovery codes. False if it isn't one of theirs, or was already used
+func (d DB) UseRecoveryCode(uid string, code string) (bool, error) {
+	defer d.observe("use_recovery_code", time.Now())
+	t, err := d.dbh.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer t.Rollback()
+	//bcrypt hashes are salted, so each one has to be checked. Locking them means the same code can't be used twice at once
+	rows, err := t.Query("select recovery_code_id, code from recovery_codes where user_id = ? for update", uid)
+	if err != nil {
+		return false, err
+	}
+	type stored struct {
+		id   int
+		hash string
+	}
+	var hashes []stored
 	for rows.Next() {
-		c++
+		var h stored
+		if err := rows.Scan(&h.id, &h.hash); err != nil {
+			rows.Close()
+			return false, err
+		}
+		hashes = append(hashes, h)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
 	}
-	var b bool
-	if c > 0 {
-		b = true
-	} else {
-		b = false
+	for _, h := range hashes {
+		if bcrypt.CompareHashAndPassword([]byte(h.hash), []byte(code)) != nil {
+			continue
+		}
+		if _, err := t.Exec("delete from recovery_codes where recovery_code_id = ?", h.id); err != nil {
+			return false, err
+		}
+		return true, t.Commit()
 	}
-	return b, err
+	return false, nil
 }
 
-//IsValidLogin will determine if the login was valid. Pass in a plain text password
-func (d DB) IsValidLogin(uid string, password string) bool {
-	rows, err := d.dbh.Query("select password from users where user_id = ?", uid)
-	check(err)
-	defer rows.Close()
-	rows.Next()
-	var epassword string
-	err = rows.Scan(&epassword)
-	check(err)
-	res := bcrypt.CompareHashAndPassword([]byte(epassword), []byte(password))
-	if res == nil {
-		return true
-	} else {
-		log.Println(res)
+//UseTOTPStep - records that the user has used the TOTP code for this time step. False if they've already used
+//that one or a later one, so a code can't be replayed
+func (d DB) UseTOTPStep(uid string, step int64) (bool, error) {
+	defer d.observe("use_totp_step", time.Now())
+	res, err := d.dbh.Exec("update users set totp_last_step = ? where user_id = ? and (totp_last_step is null or totp_last_step < ?)",
+		step, uid, step)
+	if err != nil {
+		return false, err
 	}
-	return false
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+//IsAnyRoomAdmin - whether the user is an admin of at least one room
+func (d DB) IsAnyRoomAdmin(uid string) (bool, error) {
+	defer d.observe("is_any_room_admin", time.Now())
+	var n int
+	err := d.dbh.QueryRow("select count(*) from room_users where user_id = ? and admin = 1", uid).Scan(&n)
+	return n > 0, err
 }
 
 //AddSession inserts the uuid we're handing to this client over to the user
 func (d *DB) AddSession(uid, uuid string) error {
-	res, err := d.dbh.Exec("insert into sessions (user_id,`key`) values (?,?)", uid, uuid)
-	fmt.Println(res)
+	defer d.observe("add_session", time.Now())
+	_, err := d.dbh.Exec("insert into sessions (user_id,`key`) values (?,?)", uid, uuid)
 	return err
 }
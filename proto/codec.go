@@ -0,0 +1,129 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//Codecs a connection can agree on in the hello. The hello and its response are always JSON,
+//everything after them uses whatever was picked
+const (
+	CODEC_JSON    = "json"    //newline delimited JSON, the default since you can read it off the wire
+	CODEC_MSGPACK = "msgpack" //MessagePack with a 4 byte big endian length in front of each packet
+)
+
+//codec - how packets are turned into frames on the wire and back again
+type codec interface {
+	marshal(v interface{}) ([]byte, error) //the whole frame, ready to write
+	unmarshal(data []byte, v interface{}) error
+	readFrame(r *bufio.Reader) ([]byte, error) //the next packet's bytes without the framing
+}
+
+//codecs - every codec this package can speak
+var codecs = map[string]codec{
+	CODEC_JSON:    jsonCodec{},
+	CODEC_MSGPACK: msgpackCodec{},
+}
+
+//NegotiateCodec - picks the first codec in theirs that we speak, falling back to JSON
+func NegotiateCodec(theirs []string) string {
+	for _, name := range theirs {
+		if codecs[name] != nil {
+			return name
+		}
+	}
+	return CODEC_JSON
+}
+
+//SetCodec - switches the codec for every packet sent and read after this. Call it from the goroutine that reads,
+//right after the hello is answered, so the next frame is read the new way
+func (p *Proto) SetCodec(name string) {
+	c := codecs[name]
+	if c == nil {
+		c = jsonCodec{}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.codec = c
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) marshal(v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(j, byte('\n')), nil
+}
+
+func (jsonCodec) unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+//readFrame - reads up to the next newline, refusing to buffer more than MAX_FRAME bytes of it
+func (jsonCodec) readFrame(r *bufio.Reader) ([]byte, error) {
+	var frame []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		if len(frame)+len(line) > MAX_FRAME {
+			//throw away the rest of this frame so the next one starts clean
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			if err != nil {
+				return nil, err
+			}
+			return nil, ErrFrameTooLarge
+		}
+		frame = append(frame, line...)
+		if err != bufio.ErrBufferFull {
+			return frame, err
+		}
+	}
+}
+
+//msgpackCodec - uses the json struct tags so field names match the JSON codec
+type msgpackCodec struct{}
+
+func (msgpackCodec) marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4)) //room for the length
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	frame := buf.Bytes()
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+	return frame, nil
+}
+
+func (msgpackCodec) unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	return dec.Decode(v)
+}
+
+//readFrame - reads the length and then that many bytes. A length over MAX_FRAME is ErrLengthTooLarge, without
+//reading any of it
+func (msgpackCodec) readFrame(r *bufio.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > MAX_FRAME {
+		return nil, ErrLengthTooLarge
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
@@ -0,0 +1,85 @@
+package proto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackOversizedLength(t *testing.T) {
+	for _, n := range []uint32{MAX_FRAME + 1, 1<<32 - 1} {
+		var wire bytes.Buffer
+		binary.Write(&wire, binary.BigEndian, n)
+		wire.WriteString("the rest of the stream")
+		r := bufio.NewReader(&wire)
+		_, err := msgpackCodec{}.readFrame(r)
+		if !errors.Is(err, ErrLengthTooLarge) {
+			t.Fatalf("length %d: err = %v, want ErrLengthTooLarge", n, err)
+		}
+		if Recoverable(err) {
+			t.Errorf("length %d: an oversized length was recoverable, the connection would keep reading", n)
+		}
+		//nothing past the length is read, let alone n bytes of it
+		if rest, _ := r.ReadString(0); rest != "the rest of the stream" {
+			t.Errorf("length %d: read past the length prefix, %q left", n, rest)
+		}
+	}
+}
+
+func TestMsgpackAtLimit(t *testing.T) {
+	var wire bytes.Buffer
+	binary.Write(&wire, binary.BigEndian, uint32(MAX_FRAME))
+	wire.Write(make([]byte, MAX_FRAME))
+	frame, err := msgpackCodec{}.readFrame(bufio.NewReader(&wire))
+	if err != nil || len(frame) != MAX_FRAME {
+		t.Fatalf("got %d bytes, err %v, want %d bytes", len(frame), err, MAX_FRAME)
+	}
+}
+
+//jsonLine - a frame of n bytes, counting the newline
+func jsonLine(n int) string {
+	return strings.Repeat("a", n-1) + "\n"
+}
+
+func TestJSONFrameLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		err  error
+	}{
+		{"well under the limit", 100, nil},
+		{"exactly at the limit", MAX_FRAME, nil},
+		{"one byte over", MAX_FRAME + 1, ErrFrameTooLarge},
+		{"far over", 3 * MAX_FRAME, ErrFrameTooLarge},
+	}
+	for _, tt := range tests {
+		r := bufio.NewReader(strings.NewReader(jsonLine(tt.size) + "next\n"))
+		frame, err := jsonCodec{}.readFrame(r)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err == nil && len(frame) != tt.size {
+			t.Errorf("%s: read %d bytes, want %d", tt.name, len(frame), tt.size)
+		}
+		if tt.err != nil && !Recoverable(err) {
+			t.Errorf("%s: an oversized line should only cost that packet", tt.name)
+		}
+		//whatever happened, the next frame starts clean
+		if next, err := (jsonCodec{}).readFrame(r); err != nil || string(next) != "next\n" {
+			t.Errorf("%s: next frame = %q, %v, want %q", tt.name, next, err, "next\n")
+		}
+	}
+}
+
+func TestJSONFrameOverLimitAtEOF(t *testing.T) {
+	//an oversized line the connection ends in the middle of is the connection's error, not a bad packet
+	r := bufio.NewReader(strings.NewReader(strings.Repeat("a", MAX_FRAME+1)))
+	if _, err := (jsonCodec{}).readFrame(r); err != io.EOF {
+		t.Errorf("err = %v, want io.EOF", err)
+	}
+}
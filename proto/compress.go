@@ -0,0 +1,104 @@
+package proto
+
+import (
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+//Compression a connection can agree on in the hello. Like codecs, it starts with the first packet after the hello response
+const (
+	COMPRESSION_DEFLATE = "deflate" //one deflate stream each way, flushed after every packet
+)
+
+//COMPRESSIONS - every compression this package supports, best first
+var COMPRESSIONS = []string{COMPRESSION_DEFLATE}
+
+//Stats - byte counts for a connection. Raw is packets before compression, wire is what actually went over the socket
+type Stats struct {
+	RawIn   int64
+	WireIn  int64
+	RawOut  int64
+	WireOut int64
+}
+
+//counter - counts the bytes read through it
+type counter struct {
+	r io.Reader
+	n *int64
+}
+
+func (c counter) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+//NegotiateCompression - picks the first compression in theirs that we support, or "" to go without
+func NegotiateCompression(theirs []string) string {
+	for _, name := range theirs {
+		for _, ours := range COMPRESSIONS {
+			if name == ours {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+//SetCompression - starts compressing every packet sent and read after this, "" leaves the connection alone.
+//Like SetCodec, call it from the goroutine that reads, right after the hello is answered
+func (p *Proto) SetCompression(name string) error {
+	if name == "" {
+		return nil
+	}
+	if name != COMPRESSION_DEFLATE {
+		return fmt.Errorf("proto: unsupported compression %q", name)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.zbuf.Reset()
+	w, err := flate.NewWriter(&p.zbuf, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	p.compressor = w
+	//anything the old reader already buffered is compressed too, so read through it
+	p.reader = bufio.NewReader(flate.NewReader(p.reader))
+	return nil
+}
+
+//compress - runs a frame through the compressor, if there is one. Has to be called with p.mu held so
+//frames go into the stream in the same order they go into the queue
+func (p *Proto) compress(frame []byte) ([]byte, error) {
+	atomic.AddInt64(&p.stats.RawOut, int64(len(frame)))
+	if p.compressor != nil {
+		if _, err := p.compressor.Write(frame); err != nil {
+			return nil, err
+		}
+		if err := p.compressor.Flush(); err != nil {
+			return nil, err
+		}
+		frame = append([]byte(nil), p.zbuf.Bytes()...)
+		p.zbuf.Reset()
+	}
+	atomic.AddInt64(&p.stats.WireOut, int64(len(frame)))
+	return frame, nil
+}
+
+//Stats - how many bytes this connection has moved, and how many of them compression saved
+func (p *Proto) Stats() Stats {
+	return Stats{
+		RawIn:   atomic.LoadInt64(&p.stats.RawIn),
+		WireIn:  atomic.LoadInt64(&p.stats.WireIn),
+		RawOut:  atomic.LoadInt64(&p.stats.RawOut),
+		WireOut: atomic.LoadInt64(&p.stats.WireOut),
+	}
+}
+
+//Add - sums two sets of stats
+func (s Stats) Add(o Stats) Stats {
+	return Stats{s.RawIn + o.RawIn, s.WireIn + o.WireIn, s.RawOut + o.RawOut, s.WireOut + o.WireOut}
+}
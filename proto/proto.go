@@ -2,34 +2,142 @@ package proto
 
 import (
 	"bufio"
-	"encoding/json"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	LOGIN               = "login"
-	JOINROOM            = "joinroom"
-	REGISTER_RESPONSE   = "register-response"
-	REGISTER            = "register"
-	LOGIN_RESPONSE      = "login-response"
-	MESSAGE             = "message"
-	JOINROOMRESPONSE    = "joinroom-response"
-	CREATEROOM          = "createroom"
-	CREATEROOMRESPONSE  = "createroom-response"
-	GETROOMS            = "getrooms"
-	GETROOMSRESPONSE    = "getrooms-response"
-	GETMESSAGES         = "getmessages"
-	GETMESSAGESRESPONSE = "getmessages-response"
-	POSTMESSAGE         = "postmessage"
-	POSTMESSAGERESPONSE = "postmessage-response"
-	DYNAMICMESSAGE      = "dynamicmessage"
-	HTTP_OK             = 200
-	HTTP_FORBIDDEN      = 403
-	HTTP_BADREQUEST     = 400
-	HTTP_ERROR          = 500
-	HTTP_UNAVAILABLE    = 503
+	LOGIN                    = "login"
+	JOINROOM                 = "joinroom"
+	REGISTER_RESPONSE        = "register-response"
+	REGISTER                 = "register"
+	LOGIN_RESPONSE           = "login-response"
+	MESSAGE                  = "message"
+	JOINROOMRESPONSE         = "joinroom-response"
+	CREATEROOM               = "createroom"
+	CREATEROOMRESPONSE       = "createroom-response"
+	LEAVEROOM                = "leaveroom"
+	LEAVEROOMRESPONSE        = "leaveroom-response"
+	GETROOMS                 = "getrooms"
+	GETROOMSRESPONSE         = "getrooms-response"
+	GETMESSAGES              = "getmessages"
+	GETMESSAGESRESPONSE      = "getmessages-response"
+	POSTMESSAGE              = "postmessage"
+	POSTMESSAGERESPONSE      = "postmessage-response"
+	DYNAMICMESSAGE           = "dynamicmessage"
+	RESUME                   = "resume"
+	RESUMERESPONSE           = "resume-response"
+	PING                     = "ping"
+	PONG                     = "pong"
+	PRESENCE                 = "presence"
+	ERROR                    = "error"
+	HELLO                    = "hello"
+	HELLORESPONSE            = "hello-response"
+	GOINGAWAY                = "goingaway"
+	SLOWMODE                 = "slowmode"
+	SLOWMODERESPONSE         = "slowmode-response"
+	CHANGEPASSWORD           = "changepassword"
+	CHANGEPASSWORDRESPONSE   = "changepassword-response"
+	RESETPASSWORD            = "resetpassword"
+	RESETPASSWORDRESPONSE    = "resetpassword-response"
+	TWOFACTOR                = "twofactor"
+	TWOFACTORSETUP           = "twofactor-setup"
+	TWOFACTORSETUPRESPONSE   = "twofactor-setup-response"
+	TWOFACTORENABLE          = "twofactor-enable"
+	TWOFACTORENABLERESPONSE  = "twofactor-enable-response"
+	TWOFACTORDISABLE         = "twofactor-disable"
+	TWOFACTORDISABLERESPONSE = "twofactor-disable-response"
+	HTTP_OK                  = 200
+	HTTP_FORBIDDEN           = 403
+	HTTP_BADREQUEST          = 400
+	HTTP_ERROR               = 500
+	HTTP_LOCKED              = 423
+	HTTP_UNAUTHORIZED        = 401
+	HTTP_TOO_MANY            = 429
+	HTTP_UNAVAILABLE         = 503
+)
+
+//Machine readable reasons a request failed, sent in Error.Reason
+const (
+	ERR_EMPTY_FIELD         = "empty-field"
+	ERR_BAD_LOGIN           = "bad-login"
+	ERR_BAD_KEY             = "bad-key"
+	ERR_EXISTS              = "already-exists"
+	ERR_NOT_FOUND           = "not-found"
+	ERR_MISMATCH            = "mismatch"
+	ERR_INTERNAL            = "internal"
+	ERR_UNKNOWN_TYPE        = "unknown-type"
+	ERR_MALFORMED           = "malformed"
+	ERR_VERSION             = "unsupported-version"
+	ERR_NO_HELLO            = "no-hello"
+	ERR_NO_FEATURE          = "feature-not-negotiated"
+	ERR_RATE_LIMITED        = "rate-limited"
+	ERR_SHUTDOWN            = "shutting-down"
+	ERR_NOT_ADMIN           = "not-admin"
+	ERR_LOCKED              = "locked"
+	ERR_WEAK_PASSWORD       = "weak-password"
+	ERR_BAD_TOKEN           = "bad-token"
+	ERR_BAD_CODE            = "bad-code"
+	ERR_TWO_FACTOR_REQUIRED = "two-factor-required"
+	ERR_LOGGED_IN           = "logged-in"
+	ERR_NOT_MEMBER          = "not-member"
+)
+
+//MAX_FRAME - the most bytes we'll read for a single packet
+const MAX_FRAME = 4 << 20
+
+//Errors from Decode
+var (
+	ErrFrameTooLarge = errors.New("proto: packet is larger than the maximum frame size")
+	ErrMalformed     = errors.New("proto: malformed packet")
+	ErrUnknownType   = errors.New("proto: unknown packet type")
+	//ErrLengthTooLarge - a length prefix over the maximum frame size. Unlike ErrFrameTooLarge there's no skipping
+	//it, reading that much to find the next packet is what the limit is there to stop, so the connection is done
+	ErrLengthTooLarge = errors.New("proto: packet length is larger than the maximum frame size")
+)
+
+//registry - maps the type string on the wire to the Go type it decodes into
+var registry = make(map[string]reflect.Type)
+
+//The range of protocol versions this package can speak
+const (
+	MIN_VERSION = 1
+	VERSION     = 1
+)
+
+//Optional capabilities, both ends have to list one in their hello before it's used
+const (
+	FEATURE_RESUME    = "resume"
+	FEATURE_HEARTBEAT = "heartbeat"
+	FEATURE_PRESENCE  = "presence"
+	FEATURE_PEERCRED  = "peercred" //the server knows our Unix user and will log us in as them with an empty password
+)
+
+//FEATURES - every feature this package supports, offer these in a hello
+var FEATURES = []string{FEATURE_RESUME, FEATURE_HEARTBEAT, FEATURE_PRESENCE, FEATURE_PEERCRED}
+
+//Names of the request fields an Error can point at, sent in Error.Field
+const (
+	FIELD_USERNAME     = "username"
+	FIELD_PASSWORD     = "password"
+	FIELD_KEY          = "key"
+	FIELD_ROOM         = "room"
+	FIELD_MESSAGE      = "message"
+	FIELD_VERSION      = "version"
+	FIELD_CHANNEL      = "channel"
+	FIELD_INTERVAL     = "interval"
+	FIELD_DURATION     = "duration"
+	FIELD_OLD_PASSWORD = "old_password"
+	FIELD_TOKEN        = "token"
+	FIELD_CODE         = "code"
 )
 
 //Type - Only gets the type from the decoder
@@ -55,14 +163,21 @@ type DynamicMessage struct {
 type LoginResponse struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Code      int    `json:"code"`
 	Key       string `json:"key"`
+	//for HTTP_LOCKED, why and for how many seconds
+	Message    string `json:"message,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+	//for HTTP_UNAUTHORIZED, the password was right but they have two-factor on. Send this back in a TwoFactorLogin
+	Challenge string `json:"challenge,omitempty"`
 }
 
 //RegisterResponse - Tells them if their registration was successful. They'll have to login
 type RegisterResponse struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Code      int    `json:"code"`
 }
 
@@ -70,6 +185,7 @@ type RegisterResponse struct {
 type Register struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 }
@@ -78,6 +194,7 @@ type Register struct {
 type Login struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Username  string `json:"username"`
 	Password  string `json:"password"`
 }
@@ -103,6 +220,7 @@ type MessageOrder struct {
 type JoinRoomRequest struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Room      string `json:"room"`
 	Key       string `json:"key"`
 }
@@ -111,6 +229,7 @@ type JoinRoomRequest struct {
 type JoinRoomResponse struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Room      string `json:"room"`
 	Code      int    `json:"code"`
 	RoomID    int    `json:"room_id"`
@@ -120,6 +239,7 @@ type JoinRoomResponse struct {
 type CreateRoomRequest struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Room      string `json:"room"`
 	Key       string `json:"key"`
 	Password  string `json:"password"`
@@ -129,6 +249,25 @@ type CreateRoomRequest struct {
 type CreateRoomResponse struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Room      string `json:"room"`
+	Code      int    `json:"code"`
+}
+
+//LeaveRoomRequest - Packet representing leaving a room
+type LeaveRoomRequest struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Room      string `json:"room"`
+	Key       string `json:"key"`
+}
+
+//LeaveRoomResponse - Packet representing leaving a room
+type LeaveRoomResponse struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Room      string `json:"room"`
 	Code      int    `json:"code"`
 }
@@ -137,6 +276,7 @@ type CreateRoomResponse struct {
 type GetRoomsRequest struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Key       string `json:"key"`
 }
 
@@ -168,6 +308,7 @@ type User struct {
 type GetRoomsResponse struct {
 	Type      string        `json:"type"`
 	Timestamp int64         `json:"timestamp"`
+	RequestID int           `json:"request_id,omitempty"`
 	Rooms     map[int]*Room `json:"rooms"`
 	Code      int           `json:"code"`
 }
@@ -176,6 +317,7 @@ type GetRoomsResponse struct {
 type GetMessagesResponse struct {
 	Type      string     `json:"type"`
 	Timestamp int64      `json:"timestamp"`
+	RequestID int        `json:"request_id,omitempty"`
 	Messages  []*Message `json:"messages"`
 	Code      int        `json:"code"`
 }
@@ -184,21 +326,275 @@ type GetMessagesResponse struct {
 type GetMessagesRequest struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Key       string `json:"key"`
+	Room      int    `json:"room"`
+	Channel   int    `json:"channel"`
+	Since     int    `json:"since"`
+}
+
+//ResumeRequest - sent after a reconnect to attach an existing session key to the new connection
+type ResumeRequest struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Key       string `json:"key"`
+}
+
+//ResumeResponse - tells the client if their session was picked back up
+type ResumeResponse struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Code      int    `json:"code"`
+}
+
+//Ping - either side sends this when the other has gone quiet, to see if they're still there
+type Ping struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+//Pong - the answer to a ping
+type Pong struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+//GoingAway - the server is shutting down and will close the connection once what's in flight is done
+type GoingAway struct {
+	Type       string `json:"type"`
+	Timestamp  int64  `json:"timestamp"`
+	Reason     string `json:"reason"`
+	RetryAfter int    `json:"retry_after"` //seconds to wait before reconnecting
+}
+
+//SlowModeRequest - a room admin limiting everyone in a channel to one message per Interval seconds,
+//for the next Duration seconds. An Interval of 0 turns it off
+type SlowModeRequest struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Key       string `json:"key"`
+	Room      int    `json:"room"`
+	Channel   int    `json:"channel"`
+	Interval  int    `json:"interval"`
+	Duration  int    `json:"duration"`
+}
+
+//SlowModeResponse - slow mode is set. Until is when it runs out, 0 if it was turned off
+type SlowModeResponse struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Code      int    `json:"code"`
 	Room      int    `json:"room"`
 	Channel   int    `json:"channel"`
+	Interval  int    `json:"interval"`
+	Until     int64  `json:"until"`
+}
+
+//ChangePasswordRequest - a new password for the logged in user. Every other session they have is logged out
+type ChangePasswordRequest struct {
+	Type        string `json:"type"`
+	Timestamp   int64  `json:"timestamp"`
+	RequestID   int    `json:"request_id,omitempty"`
+	Key         string `json:"key"`
+	OldPassword string `json:"old_password"`
+	Password    string `json:"password"`
+}
+
+//ChangePasswordResponse - the password was changed
+type ChangePasswordResponse struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Code      int    `json:"code"`
+}
+
+//ResetPasswordRequest - a new password for whoever a server admin gave the reset token to. No login needed
+type ResetPasswordRequest struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Token     string `json:"token"`
+	Password  string `json:"password"`
+}
+
+//ResetPasswordResponse - the password was reset, they can log in with it now
+type ResetPasswordResponse struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Code      int    `json:"code"`
+}
+
+//TwoFactorLogin - the second step of logging in, with the code from their authenticator app or a recovery code.
+//Answered with a LoginResponse
+type TwoFactorLogin struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Challenge string `json:"challenge"`
+	OTP       string `json:"otp"`
+}
+
+//TwoFactorSetupRequest - asks for a new TOTP secret. It doesn't count until it's confirmed with a TwoFactorEnableRequest
+type TwoFactorSetupRequest struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Key       string `json:"key"`
+}
+
+//TwoFactorSetupResponse - the secret, and the otpauth:// URI for authenticator apps to scan
+type TwoFactorSetupResponse struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Code      int    `json:"code"`
+	Secret    string `json:"secret"`
+	URI       string `json:"uri"`
+}
+
+//TwoFactorEnableRequest - turns two-factor on, with a code that proves their app has the secret
+type TwoFactorEnableRequest struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Key       string `json:"key"`
+	OTP       string `json:"otp"`
+}
+
+//TwoFactorEnableResponse - two-factor is on. The recovery codes are only ever sent this once
+type TwoFactorEnableResponse struct {
+	Type          string   `json:"type"`
+	Timestamp     int64    `json:"timestamp"`
+	RequestID     int      `json:"request_id,omitempty"`
+	Code          int      `json:"code"`
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+//TwoFactorDisableRequest - turns two-factor off, with a code from their app or a recovery code
+type TwoFactorDisableRequest struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Key       string `json:"key"`
+	OTP       string `json:"otp"`
+}
+
+//TwoFactorDisableResponse - two-factor is off
+type TwoFactorDisableResponse struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Code      int    `json:"code"`
+}
+
+//Presence - tells clients a user came online or went offline
+type Presence struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	UserID    int    `json:"user_id"`
+	Online    bool   `json:"online"`
+}
+
+//Error - sent in place of the normal response whenever a request fails
+type Error struct {
+	Type      string `json:"type"`
+	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
+	Code      int    `json:"code"`            //http-ish status code
+	Reason    string `json:"reason"`          //one of the ERR_ constants
+	Message   string `json:"message"`         //something we can show a person
+	Field     string `json:"field,omitempty"` //the request field that caused it, if there was one
+	//seconds to wait before trying again, for ERR_RATE_LIMITED and ERR_LOCKED
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+//Error - lets the client hand an Error packet around like any other error
+func (e Error) Error() string {
+	return e.Message
+}
+
+//Hello - has to be the first packet a client sends. Says which protocol versions and features it supports
+type Hello struct {
+	Type         string   `json:"type"`
+	Timestamp    int64    `json:"timestamp"`
+	RequestID    int      `json:"request_id,omitempty"`
+	MinVersion   int      `json:"min_version"`
+	Version      int      `json:"version"`
+	Features     []string `json:"features"`
+	Codecs       []string `json:"codecs,omitempty"`       //the codecs it would like to switch to, best first
+	Compressions []string `json:"compressions,omitempty"` //the compressions it would like, best first
+}
+
+//HelloResponse - the version the server picked and the features both ends have in common
+type HelloResponse struct {
+	Type        string   `json:"type"`
+	Timestamp   int64    `json:"timestamp"`
+	RequestID   int      `json:"request_id,omitempty"`
+	Code        int      `json:"code"`
+	Version     int      `json:"version"`
+	Features    []string `json:"features"`
+	Codec       string   `json:"codec,omitempty"`       //what both ends use after this packet, JSON if it's empty
+	Compression string   `json:"compression,omitempty"` //same, but no compression if it's empty
 }
 
 // Proto - Main object to use. Has functions to interact with stuff
 type Proto struct {
-	Conn net.Conn
-	key  string
+	Conn     net.Conn
+	reader   *bufio.Reader //lives as long as the connection so bytes past one packet aren't thrown away
+	key      string
+	features map[string]bool //what we agreed on in the hello, guarded by mu since a reconnect replaces it
+	codec    codec           //how packets are framed, see codec.go
+	//compression, see compress.go. The compressor writes into zbuf, which send hands to the writer
+	compressor *flate.Writer
+	zbuf       bytes.Buffer
+	stats      Stats
+	//everything written to Conn goes through out to a single writer goroutine, see writer.go
+	mu   sync.Mutex
+	out  chan []byte
+	done chan struct{}
+	once *sync.Once
+	err  error
+}
+
+//New - makes a Proto to talk over conn and starts its writer
+func New(conn net.Conn) *Proto {
+	p := &Proto{}
+	p.Reset(conn)
+	return p
+}
+
+//Reset - switches over to a new connection, like after a reconnect. The old one is closed.
+//The session key is kept, features have to be agreed on again
+func (p *Proto) Reset(conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done != nil {
+		p.closeLocked()
+	}
+	p.Conn = conn
+	p.stats = Stats{}
+	p.reader = bufio.NewReader(counter{conn, &p.stats.WireIn})
+	p.features = nil
+	p.codec = jsonCodec{}
+	p.compressor = nil
+	p.zbuf.Reset()
+	p.out = make(chan []byte, OUTBOUND_QUEUE)
+	p.done = make(chan struct{})
+	p.once = new(sync.Once)
+	p.err = nil
+	go p.writer(conn, p.out, p.done)
 }
 
 //PostMessageRequest -
 type PostMessageRequest struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Key       string `json:"key"`
 	Room      int    `json:"room"`
 	Channel   int    `json:"channel"`
@@ -209,106 +605,207 @@ type PostMessageRequest struct {
 type PostMessageResponse struct {
 	Type      string `json:"type"`
 	Timestamp int64  `json:"timestamp"`
+	RequestID int    `json:"request_id,omitempty"`
 	Code      int    `json:"code"`
 }
 
 //SendDynamicMessage -
 func (p *Proto) SendDynamicMessage(dm *DynamicMessage) error {
-	j, err := json.Marshal(dm)
-	if err != nil {
-		return err
-	}
-
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(dm)
 }
 
 //SendPostMessageRequest -
-func (p *Proto) SendPostMessageRequest(msg string, room int, channel int) error {
+func (p *Proto) SendPostMessageRequest(rid int, msg string, room int, channel int) error {
 	pmr := PostMessageRequest{}
+	pmr.RequestID = rid
 	pmr.Timestamp = time.Now().Unix()
 	pmr.Room = room
 	pmr.Channel = channel
 	pmr.Type = POSTMESSAGE
 	pmr.Key = p.key
 	pmr.Message = msg
-	j, err := json.Marshal(pmr)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(pmr)
 }
 
 //SendPostMessageResponse -
-func (p *Proto) SendPostMessageResponse(c int) error {
+func (p *Proto) SendPostMessageResponse(rid int, c int) error {
 	pmr := PostMessageResponse{}
+	pmr.RequestID = rid
 	pmr.Timestamp = time.Now().Unix()
 	pmr.Type = POSTMESSAGERESPONSE
 	pmr.Code = c
-	j, err := json.Marshal(pmr)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(pmr)
 }
 
 //SendGetMessagesRequest -sends a request to get messages for a specific channel
-func (p *Proto) SendGetMessagesRequest(room int, channel int) error {
+func (p *Proto) SendGetMessagesRequest(rid int, room int, channel int) error {
+	return p.SendGetMessagesSinceRequest(rid, room, channel, 0)
+}
+
+//SendGetMessagesSinceRequest - sends a request to get the messages in a channel newer than the since message id
+func (p *Proto) SendGetMessagesSinceRequest(rid int, room int, channel int, since int) error {
 	mr := GetMessagesRequest{}
+	mr.RequestID = rid
 	mr.Timestamp = time.Now().Unix()
 	mr.Room = room
 	mr.Channel = channel
+	mr.Since = since
 	mr.Type = GETMESSAGES
 	mr.Key = p.key
-	j, err := json.Marshal(mr)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(mr)
 }
 
 //SendGetMessagesResponse - sends a response to a getmessages request
-func (p *Proto) SendGetMessagesResponse(c int, m []*Message) error {
+func (p *Proto) SendGetMessagesResponse(rid int, c int, m []*Message) error {
 	gmr := GetMessagesResponse{}
+	gmr.RequestID = rid
 	gmr.Timestamp = time.Now().Unix()
 	gmr.Type = GETMESSAGESRESPONSE
 	gmr.Messages = m
 	gmr.Code = c
-	j, err := json.Marshal(gmr)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(gmr)
 }
 
 // SendJoinRoom -  sends a request to join a room
-func (p *Proto) SendJoinRoom(name string, password string) error {
+func (p *Proto) SendJoinRoom(rid int, name string, password string) error {
 	jr := JoinRoomRequest{}
+	jr.RequestID = rid
 	jr.Room = name
 	jr.Timestamp = time.Now().Unix()
 	jr.Type = JOINROOM
 	jr.Key = p.key
-	j, err := json.Marshal(jr)
-	if err != nil {
-		return err
+	return p.send(jr)
+}
+
+//SendResume - asks the server to attach our session key to this connection
+func (p *Proto) SendResume(rid int) error {
+	r := ResumeRequest{}
+	r.RequestID = rid
+	r.Timestamp = time.Now().Unix()
+	r.Type = RESUME
+	r.Key = p.key
+	return p.send(r)
+}
+
+//SendResumeResponse - tells the client how resuming their session went
+func (p *Proto) SendResumeResponse(rid int, code int) error {
+	rr := ResumeResponse{}
+	rr.RequestID = rid
+	rr.Timestamp = time.Now().Unix()
+	rr.Type = RESUMERESPONSE
+	rr.Code = code
+	return p.send(rr)
+}
+
+//SendPing - checks if the other end is still alive
+func (p *Proto) SendPing() error {
+	pi := Ping{}
+	pi.Timestamp = time.Now().Unix()
+	pi.Type = PING
+	return p.send(pi)
+}
+
+//SendPong - answers a ping
+func (p *Proto) SendPong() error {
+	po := Pong{}
+	po.Timestamp = time.Now().Unix()
+	po.Type = PONG
+	return p.send(po)
+}
+
+//SendPresence - tells the client a user came online or went offline
+func (p *Proto) SendPresence(uid int, online bool) error {
+	pr := Presence{}
+	pr.Timestamp = time.Now().Unix()
+	pr.Type = PRESENCE
+	pr.UserID = uid
+	pr.Online = online
+	return p.send(pr)
+}
+
+//SendGoingAway - warns the client we're shutting down, and when it's worth coming back
+func (p *Proto) SendGoingAway(reason string, retryAfter time.Duration) error {
+	ga := GoingAway{}
+	ga.Timestamp = time.Now().Unix()
+	ga.Type = GOINGAWAY
+	ga.Reason = reason
+	ga.RetryAfter = int(retryAfter / time.Second)
+	return p.send(ga)
+}
+
+//SendHello - offers our protocol versions and features to the server, along with any codecs we'd rather use than JSON
+//and the compressions we'd like
+func (p *Proto) SendHello(rid int, codecs []string, compressions []string) error {
+	h := Hello{}
+	h.RequestID = rid
+	h.Timestamp = time.Now().Unix()
+	h.Type = HELLO
+	h.MinVersion = MIN_VERSION
+	h.Version = VERSION
+	h.Features = FEATURES
+	h.Codecs = codecs
+	h.Compressions = compressions
+	return p.send(h)
+}
+
+//SendHelloResponse - tells the client which version, features, codec and compression we settled on
+func (p *Proto) SendHelloResponse(rid int, version int, features []string, codec string, compression string) error {
+	hr := HelloResponse{}
+	hr.RequestID = rid
+	hr.Timestamp = time.Now().Unix()
+	hr.Type = HELLORESPONSE
+	hr.Code = HTTP_OK
+	hr.Version = version
+	hr.Features = features
+	hr.Codec = codec
+	hr.Compression = compression
+	return p.send(hr)
+}
+
+//NegotiateVersion - picks the highest version both ends can speak, or -1 if there isn't one
+func NegotiateVersion(min int, max int) int {
+	if max > VERSION {
+		max = VERSION
+	}
+	if min < MIN_VERSION {
+		min = MIN_VERSION
+	}
+	if max < min {
+		return -1
+	}
+	return max
+}
+
+//CommonFeatures - the features in theirs that we support too
+func CommonFeatures(theirs []string) []string {
+	common := make([]string, 0)
+	for _, f := range theirs {
+		for _, ours := range FEATURES {
+			if f == ours {
+				common = append(common, f)
+				break
+			}
+		}
+	}
+	return common
+}
+
+//SetFeatures - remember the features both ends agreed on
+func (p *Proto) SetFeatures(features []string) {
+	agreed := make(map[string]bool)
+	for _, f := range features {
+		agreed[f] = true
 	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.features = agreed
+}
+
+//Has - true if both ends agreed on this feature in the hello
+func (p *Proto) Has(feature string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.features[feature]
 }
 
 //SetKey - set the session key for the protocol to use
@@ -317,278 +814,454 @@ func (p *Proto) SetKey(key string) {
 }
 
 //SendLogin - For clients to send their credentials to the server
-func (p Proto) SendLogin(username string, password string) error {
+func (p *Proto) SendLogin(rid int, username string, password string) error {
 	l := Login{}
+	l.RequestID = rid
 	l.Username = username
 	l.Password = password
 	l.Type = LOGIN
 	l.Timestamp = time.Now().Unix()
-	j, err := json.Marshal(l)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(l)
 }
 
 //SendCreateRoom - tells the server to create a room
-func (p Proto) SendCreateRoom(name string, password string) error {
+func (p *Proto) SendCreateRoom(rid int, name string, password string) error {
 	cr := CreateRoomRequest{}
+	cr.RequestID = rid
 	cr.Room = name
 	cr.Timestamp = time.Now().Unix()
 	cr.Type = CREATEROOM
 	cr.Key = p.key
 	cr.Password = password
-	j, err := json.Marshal(cr)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(cr)
+}
+
+//SendLeaveRoom - tells the server we're leaving a room
+func (p *Proto) SendLeaveRoom(rid int, name string) error {
+	lr := LeaveRoomRequest{}
+	lr.RequestID = rid
+	lr.Room = name
+	lr.Timestamp = time.Now().Unix()
+	lr.Type = LEAVEROOM
+	lr.Key = p.key
+	return p.send(lr)
+}
+
+//SendLeaveRoomResponse - sends a leave room response to the client
+func (p *Proto) SendLeaveRoomResponse(rid int, r string, code int) error {
+	lrr := LeaveRoomResponse{}
+	lrr.RequestID = rid
+	lrr.Timestamp = time.Now().Unix()
+	lrr.Type = LEAVEROOMRESPONSE
+	lrr.Code = code
+	lrr.Room = r
+	return p.send(lrr)
 }
 
 //SendCreateRoomResponse - sends a create room response to the client
-func (p Proto) SendCreateRoomResponse(r string, code int) error {
+func (p *Proto) SendCreateRoomResponse(rid int, r string, code int) error {
 	jrr := CreateRoomResponse{}
+	jrr.RequestID = rid
 	jrr.Timestamp = time.Now().Unix()
 	jrr.Type = CREATEROOMRESPONSE
 	jrr.Code = code
 	jrr.Room = r
-	j, err := json.Marshal(jrr)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(jrr)
 }
 
 //SendJoinRoomResponse - sends a join room response to the client
-func (p Proto) SendJoinRoomResponse(r string, code int, rid int) error {
+func (p *Proto) SendJoinRoomResponse(rid int, r string, code int, roomid int) error {
 	jrr := JoinRoomResponse{}
+	jrr.RequestID = rid
 	jrr.Timestamp = time.Now().Unix()
 	jrr.Type = JOINROOMRESPONSE
 	jrr.Code = code
 	jrr.Room = r
-	jrr.RoomID = rid
-	j, err := json.Marshal(jrr)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	jrr.RoomID = roomid
+	return p.send(jrr)
 }
 
 //SendRegistrationResponse - sends a registration packet to the client
-func (p Proto) SendRegistrationResponse(code int) error {
+func (p *Proto) SendRegistrationResponse(rid int, code int) error {
 	rr := RegisterResponse{}
+	rr.RequestID = rid
 	rr.Timestamp = time.Now().Unix()
 	rr.Type = REGISTER_RESPONSE
 	rr.Code = code
-	j, err := json.Marshal(rr)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(rr)
 }
 
 //SendRegistration - sends a registration packet to the server
-func (p Proto) SendRegistration(username string, password string) error {
+func (p *Proto) SendRegistration(rid int, username string, password string) error {
 	r := Register{}
+	r.RequestID = rid
 	r.Timestamp = time.Now().Unix()
 	r.Type = REGISTER
 	r.Username = username
 	r.Password = password
-	j, err := json.Marshal(r)
-	if err != nil {
-		return err
-	}
-	//TODO compress into one call
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(r)
 }
 
-//SendBadLoginResponse - send a bad login response back ot the client
-func (p Proto) SendBadLoginResponse() error {
-	lr := LoginResponse{}
-	lr.Timestamp = time.Now().Unix()
-	lr.Code = HTTP_FORBIDDEN
-	lr.Key = ""
-	lr.Type = LOGIN_RESPONSE
-	j, err := json.Marshal(lr)
-	if err != nil {
-		return err
+//SendError - tells the client why their request failed
+func (p *Proto) SendError(rid int, code int, reason string, message string, field string) error {
+	e := Error{}
+	e.RequestID = rid
+	e.Timestamp = time.Now().Unix()
+	e.Type = ERROR
+	e.Code = code
+	e.Reason = reason
+	e.Message = message
+	e.Field = field
+	return p.send(e)
+}
+
+//SendRateLimited - tells the client they're going too fast, and how long until they can try again
+func (p *Proto) SendRateLimited(rid int, message string, retryAfter time.Duration) error {
+	e := Error{}
+	e.RequestID = rid
+	e.Timestamp = time.Now().Unix()
+	e.Type = ERROR
+	e.Code = HTTP_TOO_MANY
+	e.Reason = ERR_RATE_LIMITED
+	e.Message = message
+	//round up, telling them 0 would have them straight back
+	e.RetryAfter = int((retryAfter + time.Second - 1) / time.Second)
+	return p.send(e)
+}
+
+//SendLocked - tells the client they're locked out after too many failures, and for how long. Logins get
+//SendLoginLocked instead
+func (p *Proto) SendLocked(rid int, message string, retryAfter time.Duration) error {
+	e := Error{}
+	e.RequestID = rid
+	e.Timestamp = time.Now().Unix()
+	e.Type = ERROR
+	e.Code = HTTP_LOCKED
+	e.Reason = ERR_LOCKED
+	e.Message = message
+	e.RetryAfter = int((retryAfter + time.Second - 1) / time.Second)
+	return p.send(e)
+}
+
+//SendSlowMode - asks the server to slow a channel down to one message per interval, for duration. 0 turns it off
+func (p *Proto) SendSlowMode(rid int, room int, channel int, interval time.Duration, duration time.Duration) error {
+	sm := SlowModeRequest{}
+	sm.RequestID = rid
+	sm.Timestamp = time.Now().Unix()
+	sm.Type = SLOWMODE
+	sm.Key = p.key
+	sm.Room = room
+	sm.Channel = channel
+	sm.Interval = int(interval / time.Second)
+	sm.Duration = int(duration / time.Second)
+	return p.send(sm)
+}
+
+//SendSlowModeResponse - tells the admin slow mode is set, and until when
+func (p *Proto) SendSlowModeResponse(rid int, room int, channel int, interval time.Duration, until time.Time) error {
+	smr := SlowModeResponse{}
+	smr.RequestID = rid
+	smr.Timestamp = time.Now().Unix()
+	smr.Type = SLOWMODERESPONSE
+	smr.Code = HTTP_OK
+	smr.Room = room
+	smr.Channel = channel
+	smr.Interval = int(interval / time.Second)
+	if !until.IsZero() {
+		smr.Until = until.Unix()
 	}
-	//we might need a newline but if the other end is go we should be fine?
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(smr)
 }
 
 //SendLoginResponse - send a login response back ot the client
-func (p Proto) SendLoginResponse(key string) error {
+func (p *Proto) SendLoginResponse(rid int, key string) error {
 	if key == "" {
 		log.Println("UUID must be invalid")
 		return nil
 	}
 	lr := LoginResponse{}
+	lr.RequestID = rid
 	lr.Timestamp = time.Now().Unix()
 	lr.Code = HTTP_OK
 	lr.Key = key
 	lr.Type = LOGIN_RESPONSE
-	j, err := json.Marshal(lr)
-	if err != nil {
-		return err
-	}
-	//we might need a newline but if the other end is go we should be fine?
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(lr)
+}
+
+//SendChangePassword - asks for a new password. This session stays logged in, the others don't
+func (p *Proto) SendChangePassword(rid int, oldPassword string, password string) error {
+	cp := ChangePasswordRequest{}
+	cp.RequestID = rid
+	cp.Timestamp = time.Now().Unix()
+	cp.Type = CHANGEPASSWORD
+	cp.Key = p.key
+	cp.OldPassword = oldPassword
+	cp.Password = password
+	return p.send(cp)
+}
+
+//SendChangePasswordResponse - tells the client their password was changed
+func (p *Proto) SendChangePasswordResponse(rid int) error {
+	cpr := ChangePasswordResponse{}
+	cpr.RequestID = rid
+	cpr.Timestamp = time.Now().Unix()
+	cpr.Type = CHANGEPASSWORDRESPONSE
+	cpr.Code = HTTP_OK
+	return p.send(cpr)
+}
+
+//SendResetPassword - sets a new password with a reset token from a server admin
+func (p *Proto) SendResetPassword(rid int, token string, password string) error {
+	rp := ResetPasswordRequest{}
+	rp.RequestID = rid
+	rp.Timestamp = time.Now().Unix()
+	rp.Type = RESETPASSWORD
+	rp.Token = token
+	rp.Password = password
+	return p.send(rp)
+}
+
+//SendResetPasswordResponse - tells the client the reset worked
+func (p *Proto) SendResetPasswordResponse(rid int) error {
+	rpr := ResetPasswordResponse{}
+	rpr.RequestID = rid
+	rpr.Timestamp = time.Now().Unix()
+	rpr.Type = RESETPASSWORDRESPONSE
+	rpr.Code = HTTP_OK
+	return p.send(rpr)
+}
+
+//SendTwoFactorChallenge - tells the client the password was right, and now we need a code
+func (p *Proto) SendTwoFactorChallenge(rid int, challenge string) error {
+	lr := LoginResponse{}
+	lr.RequestID = rid
+	lr.Timestamp = time.Now().Unix()
+	lr.Code = HTTP_UNAUTHORIZED
+	lr.Message = "Enter the code from your authenticator app"
+	lr.Challenge = challenge
+	lr.Type = LOGIN_RESPONSE
+	return p.send(lr)
+}
+
+//SendTwoFactorLogin - finishes logging in with a code
+func (p *Proto) SendTwoFactorLogin(rid int, challenge string, otp string) error {
+	tf := TwoFactorLogin{}
+	tf.RequestID = rid
+	tf.Timestamp = time.Now().Unix()
+	tf.Type = TWOFACTOR
+	tf.Challenge = challenge
+	tf.OTP = otp
+	return p.send(tf)
+}
+
+//SendTwoFactorSetup - asks for a new TOTP secret
+func (p *Proto) SendTwoFactorSetup(rid int) error {
+	ts := TwoFactorSetupRequest{}
+	ts.RequestID = rid
+	ts.Timestamp = time.Now().Unix()
+	ts.Type = TWOFACTORSETUP
+	ts.Key = p.key
+	return p.send(ts)
+}
+
+//SendTwoFactorSetupResponse - hands the client their new secret
+func (p *Proto) SendTwoFactorSetupResponse(rid int, secret string, uri string) error {
+	tsr := TwoFactorSetupResponse{}
+	tsr.RequestID = rid
+	tsr.Timestamp = time.Now().Unix()
+	tsr.Type = TWOFACTORSETUPRESPONSE
+	tsr.Code = HTTP_OK
+	tsr.Secret = secret
+	tsr.URI = uri
+	return p.send(tsr)
+}
+
+//SendTwoFactorEnable - confirms the new secret with a code from it, turning two-factor on
+func (p *Proto) SendTwoFactorEnable(rid int, otp string) error {
+	te := TwoFactorEnableRequest{}
+	te.RequestID = rid
+	te.Timestamp = time.Now().Unix()
+	te.Type = TWOFACTORENABLE
+	te.Key = p.key
+	te.OTP = otp
+	return p.send(te)
+}
+
+//SendTwoFactorEnableResponse - tells the client two-factor is on, with their recovery codes
+func (p *Proto) SendTwoFactorEnableResponse(rid int, recoveryCodes []string) error {
+	ter := TwoFactorEnableResponse{}
+	ter.RequestID = rid
+	ter.Timestamp = time.Now().Unix()
+	ter.Type = TWOFACTORENABLERESPONSE
+	ter.Code = HTTP_OK
+	ter.RecoveryCodes = recoveryCodes
+	return p.send(ter)
+}
+
+//SendTwoFactorDisable - turns two-factor off
+func (p *Proto) SendTwoFactorDisable(rid int, otp string) error {
+	td := TwoFactorDisableRequest{}
+	td.RequestID = rid
+	td.Timestamp = time.Now().Unix()
+	td.Type = TWOFACTORDISABLE
+	td.Key = p.key
+	td.OTP = otp
+	return p.send(td)
+}
+
+//SendTwoFactorDisableResponse - tells the client two-factor is off
+func (p *Proto) SendTwoFactorDisableResponse(rid int) error {
+	tdr := TwoFactorDisableResponse{}
+	tdr.RequestID = rid
+	tdr.Timestamp = time.Now().Unix()
+	tdr.Type = TWOFACTORDISABLERESPONSE
+	tdr.Code = HTTP_OK
+	return p.send(tdr)
+}
+
+//SendLoginLocked - tells the client the account (or their address) is locked out for now, after too many failed logins
+func (p *Proto) SendLoginLocked(rid int, message string, retryAfter time.Duration) error {
+	lr := LoginResponse{}
+	lr.RequestID = rid
+	lr.Timestamp = time.Now().Unix()
+	lr.Code = HTTP_LOCKED
+	lr.Message = message
+	lr.RetryAfter = int((retryAfter + time.Second - 1) / time.Second)
+	lr.Type = LOGIN_RESPONSE
+	return p.send(lr)
 }
 
 //SendGetRoomsRequest - tell the server you want some room data
-func (p Proto) SendGetRoomsRequest() error {
+func (p *Proto) SendGetRoomsRequest(rid int) error {
 	gr := GetRoomsRequest{}
+	gr.RequestID = rid
 	gr.Timestamp = time.Now().Unix()
 	gr.Type = GETROOMS
 	gr.Key = p.key
-	j, err := json.Marshal(gr)
-	if err != nil {
-		return err
-	}
-	//we might need a newline but if the other end is go we should be fine?
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(gr)
 }
 
 //SendGetRoomsResponse -
-func (p Proto) SendGetRoomsResponse(code int, rooms map[int]*Room) error {
+func (p *Proto) SendGetRoomsResponse(rid int, code int, rooms map[int]*Room) error {
 	grr := GetRoomsResponse{}
+	grr.RequestID = rid
 	grr.Timestamp = time.Now().Unix()
 	grr.Rooms = rooms
 	grr.Type = GETROOMSRESPONSE
 	grr.Code = code
-	j, err := json.Marshal(grr)
-	if err != nil {
-		return err
-	}
-	//we might need a newline but if the other end is go we should be fine?
-	tmp := append([]byte(j), byte('\n'))
-	p.Conn.Write(tmp)
-	return nil
+	return p.send(grr)
 }
 
-//Decode - returns a type defined in this package
-func (p Proto) Decode() interface{} {
-
-	text, err := bufio.NewReader(p.Conn).ReadBytes('\n')
+//Decode - reads the next packet off the connection and returns it as one of the types defined in this package.
+//Errors that Recoverable says are recoverable only spoil that one packet, anything else means the connection is done
+func (p *Proto) Decode() (interface{}, error) {
+	if p.reader == nil {
+		p.reader = bufio.NewReader(p.Conn)
+	}
+	p.mu.Lock()
+	c := p.codec
+	p.mu.Unlock()
+	if c == nil {
+		c = jsonCodec{}
+	}
+	text, err := c.readFrame(p.reader)
 	if err != nil {
-		log.Println(err)
-		return nil
+		return nil, err
 	}
+	atomic.AddInt64(&p.stats.RawIn, int64(len(text)))
 
 	var a Type
-	err = json.Unmarshal(text, &a)
-	check(err)
-
-	if a.Type == LOGIN {
-		var l Login
-		err := json.Unmarshal(text, &l)
-		check(err)
-		return l
-	} else if a.Type == MESSAGE {
-		var m Message
-		err := json.Unmarshal(text, &m)
-		check(err)
-		return m
-	} else if a.Type == LOGIN_RESPONSE {
-		var lr LoginResponse
-		err := json.Unmarshal(text, &lr)
-		check(err)
-		return lr
-	} else if a.Type == REGISTER {
-		var r Register
-		err := json.Unmarshal(text, &r)
-		check(err)
-		return r
-	} else if a.Type == REGISTER_RESPONSE {
-		var rr RegisterResponse
-		err := json.Unmarshal(text, &rr)
-		check(err)
-		return rr
-	} else if a.Type == JOINROOM {
-		var jr JoinRoomRequest
-		err := json.Unmarshal(text, &jr)
-		check(err)
-		return jr
-	} else if a.Type == JOINROOMRESPONSE {
-		var jrr JoinRoomResponse
-		err := json.Unmarshal(text, &jrr)
-		check(err)
-		return jrr
-	} else if a.Type == CREATEROOMRESPONSE {
-		var crr CreateRoomResponse
-		err := json.Unmarshal(text, &crr)
-		check(err)
-		return crr
-	} else if a.Type == CREATEROOM {
-		var cr CreateRoomRequest
-		err := json.Unmarshal(text, &cr)
-		check(err)
-		return cr
-	} else if a.Type == GETROOMS {
-		var gr GetRoomsRequest
-		err := json.Unmarshal(text, &gr)
-		check(err)
-		return gr
-	} else if a.Type == GETROOMSRESPONSE {
-		var grr GetRoomsResponse
-		err := json.Unmarshal(text, &grr)
-		check(err)
-		return grr
-	} else if a.Type == GETMESSAGES {
-		var gmr GetMessagesRequest
-		err := json.Unmarshal(text, &gmr)
-		check(err)
-		return gmr
-	} else if a.Type == GETMESSAGESRESPONSE {
-		var gmr GetMessagesResponse
-		err := json.Unmarshal(text, &gmr)
-		check(err)
-		return gmr
-	} else if a.Type == POSTMESSAGE {
-		var pmr PostMessageRequest
-		err := json.Unmarshal(text, &pmr)
-		check(err)
-		return pmr
-	} else if a.Type == POSTMESSAGERESPONSE {
-		var pmr PostMessageResponse
-		err := json.Unmarshal(text, &pmr)
-		check(err)
-		return pmr
-	} else if a.Type == DYNAMICMESSAGE {
-		var dm DynamicMessage
-		err := json.Unmarshal(text, &dm)
-		check(err)
-		return dm
+	err = c.unmarshal(text, &a)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	t, ok := registry[a.Type]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownType, a.Type)
+	}
+	v := reflect.New(t)
+	err = c.unmarshal(text, v.Interface())
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrMalformed, a.Type, err)
+	}
+	return v.Elem().Interface(), nil
+}
+
+//Recoverable - true if the error from Decode only affected one packet and the connection can keep being read
+func Recoverable(err error) bool {
+	return errors.Is(err, ErrMalformed) || errors.Is(err, ErrUnknownType) || errors.Is(err, ErrFrameTooLarge)
+}
+
+//RequestIDOf - the request id of any packet from Decode, 0 if it doesn't have one
+func RequestIDOf(msg interface{}) int {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Struct {
+		return 0
 	}
-	return nil
+	f := v.FieldByName("RequestID")
+	if !f.IsValid() || f.Kind() != reflect.Int {
+		return 0
+	}
+	return int(f.Int())
 }
 
-func check(e error) {
-	if e != nil {
-		panic(e)
+//TypeOf - the type string of any packet from Decode, like "login", empty if it doesn't have one
+func TypeOf(msg interface{}) string {
+	v := reflect.ValueOf(msg)
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	f := v.FieldByName("Type")
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return ""
 	}
+	return f.String()
+}
+
+//RegisterType - tells Decode which Go type a type string on the wire decodes into
+func RegisterType(t string, v interface{}) {
+	registry[t] = reflect.TypeOf(v)
+}
+
+func init() {
+	RegisterType(LOGIN, Login{})
+	RegisterType(LOGIN_RESPONSE, LoginResponse{})
+	RegisterType(MESSAGE, Message{})
+	RegisterType(REGISTER, Register{})
+	RegisterType(REGISTER_RESPONSE, RegisterResponse{})
+	RegisterType(JOINROOM, JoinRoomRequest{})
+	RegisterType(JOINROOMRESPONSE, JoinRoomResponse{})
+	RegisterType(CREATEROOM, CreateRoomRequest{})
+	RegisterType(CREATEROOMRESPONSE, CreateRoomResponse{})
+	RegisterType(LEAVEROOM, LeaveRoomRequest{})
+	RegisterType(LEAVEROOMRESPONSE, LeaveRoomResponse{})
+	RegisterType(GETROOMS, GetRoomsRequest{})
+	RegisterType(GETROOMSRESPONSE, GetRoomsResponse{})
+	RegisterType(GETMESSAGES, GetMessagesRequest{})
+	RegisterType(GETMESSAGESRESPONSE, GetMessagesResponse{})
+	RegisterType(POSTMESSAGE, PostMessageRequest{})
+	RegisterType(POSTMESSAGERESPONSE, PostMessageResponse{})
+	RegisterType(DYNAMICMESSAGE, DynamicMessage{})
+	RegisterType(RESUME, ResumeRequest{})
+	RegisterType(RESUMERESPONSE, ResumeResponse{})
+	RegisterType(PING, Ping{})
+	RegisterType(PONG, Pong{})
+	RegisterType(PRESENCE, Presence{})
+	RegisterType(HELLO, Hello{})
+	RegisterType(HELLORESPONSE, HelloResponse{})
+	RegisterType(ERROR, Error{})
+	RegisterType(GOINGAWAY, GoingAway{})
+	RegisterType(SLOWMODE, SlowModeRequest{})
+	RegisterType(SLOWMODERESPONSE, SlowModeResponse{})
+	RegisterType(CHANGEPASSWORD, ChangePasswordRequest{})
+	RegisterType(CHANGEPASSWORDRESPONSE, ChangePasswordResponse{})
+	RegisterType(RESETPASSWORD, ResetPasswordRequest{})
+	RegisterType(RESETPASSWORDRESPONSE, ResetPasswordResponse{})
+	RegisterType(TWOFACTOR, TwoFactorLogin{})
+	RegisterType(TWOFACTORSETUP, TwoFactorSetupRequest{})
+	RegisterType(TWOFACTORSETUPRESPONSE, TwoFactorSetupResponse{})
+	RegisterType(TWOFACTORENABLE, TwoFactorEnableRequest{})
+	RegisterType(TWOFACTORENABLERESPONSE, TwoFactorEnableResponse{})
+	RegisterType(TWOFACTORDISABLE, TwoFactorDisableRequest{})
+	RegisterType(TWOFACTORDISABLERESPONSE, TwoFactorDisableResponse{})
 }
@@ -0,0 +1,125 @@
+package proto
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	OUTBOUND_QUEUE = 256              //packets we'll hold for a connection before calling it a slow consumer
+	WRITE_TIMEOUT  = 10 * time.Second //how long one write can take before the connection is given up on
+)
+
+//Errors from the Send functions
+var (
+	ErrSlowConsumer = errors.New("proto: outbound queue is full, dropping the connection")
+	ErrClosed       = errors.New("proto: connection is closed")
+)
+
+//send - queues a packet for the writer. Never blocks: if the other end can't keep up with its queue we
+//drop them rather than hold up whoever is sending (like a message fan-out)
+func (p *Proto) send(v interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	tmp, err := p.codec.marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err = p.compress(tmp)
+	if err != nil {
+		return err
+	}
+	select {
+	case p.out <- tmp:
+		return nil
+	default:
+		p.failLocked(ErrSlowConsumer)
+		return ErrSlowConsumer
+	}
+}
+
+//writer - the only goroutine that writes to conn. On Close it flushes what's left in the queue before hanging up
+func (p *Proto) writer(conn net.Conn, out chan []byte, done chan struct{}) {
+	for {
+		select {
+		case frame := <-out:
+			conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			if _, err := conn.Write(frame); err != nil {
+				p.fail(conn, err)
+				return
+			}
+		case <-done:
+			//flush whatever is still queued, all of it sharing one deadline
+			conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			for {
+				select {
+				case frame := <-out:
+					if _, err := conn.Write(frame); err != nil {
+						conn.Close()
+						return
+					}
+				default:
+					conn.Close()
+					return
+				}
+			}
+		}
+	}
+}
+
+//fail - remembers the first write error on conn and hangs up, if conn is still the one we're using
+func (p *Proto) fail(conn net.Conn, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.Conn == conn {
+		p.failLocked(err)
+	} else {
+		conn.Close()
+	}
+}
+
+func (p *Proto) failLocked(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+	p.once.Do(func() {
+		close(p.done)
+	})
+	//don't wait for the writer to notice, a stalled write needs the socket closed to give up
+	p.Conn.Close()
+}
+
+//Err - the error that stopped the writer, if there was one
+func (p *Proto) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+//Close - stops taking new packets, and hangs up once the ones already queued are written
+func (p *Proto) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closeLocked()
+	return nil
+}
+
+func (p *Proto) closeLocked() {
+	if p.err == nil {
+		p.err = ErrClosed
+	}
+	p.once.Do(func() {
+		close(p.done)
+	})
+}
+
+//Queued - how many packets are waiting on the writer
+func (p *Proto) Queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.out)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	ttdb "termtexter/db"
+)
+
+const (
+	COMMANDS_USAGE = "commands:\n  unlock <username>\tlets a user locked out by failed logins back in\n" +
+		"  reset <username>\tprints a one-time token they can set a new password with\n" +
+		"  disable-2fa <username>\tturns off two-factor for a user who lost their authenticator and recovery codes"
+)
+
+//runCommand - the admin commands, run like termtexter-server -config termtexter.toml unlock bob.
+//They work on the database directly, so the server doesn't have to be running. Returns the exit code
+func runCommand(c *Config, args []string) int {
+	switch args[0] {
+	case "unlock":
+		return unlock(c, args[1:])
+	case "reset":
+		return reset(c, args[1:])
+	case "disable-2fa":
+		return disableTwoFactor(c, args[1:])
+	}
+	fmt.Fprintf(os.Stderr, "%s isn't a command\n%s\n", args[0], COMMANDS_USAGE)
+	return 2
+}
+
+//connect - the database from the config, for commands
+func connect(c *Config) (*ttdb.DB, error) {
+	db := &ttdb.DB{}
+	if err := db.Connect(c.DB.Backend, c.DB.DSN); err != nil {
+		return nil, fmt.Errorf("couldn't connect to the database: %w", err)
+	}
+	return db, nil
+}
+
+//unlock - clears a user's failed logins and lockout
+func unlock(c *Config, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: termtexter-server [flags] unlock <username>")
+		return 2
+	}
+	db, err := connect(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+	err = db.UnlockUser(args[0])
+	if errors.Is(err, ttdb.ErrNotFound) {
+		fmt.Fprintln(os.Stderr, "There's no user called", args[0])
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't unlock them:", err)
+		return 1
+	}
+	fmt.Println("Unlocked", args[0])
+	return 0
+}
+
+//reset - gives a user a one-time password reset token, for when they can't log in at all. Hand it to them
+//however you trust, they pick Reset on the client's login page and use it there
+func reset(c *Config, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: termtexter-server [flags] reset <username>")
+		return 2
+	}
+	db, err := connect(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+	token, hash, err := newResetToken()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't make a token:", err)
+		return 1
+	}
+	expires := time.Now().Add(c.Password.ResetLifetime.Duration)
+	err = db.SetResetToken(args[0], hash, expires)
+	if errors.Is(err, ttdb.ErrNotFound) {
+		fmt.Fprintln(os.Stderr, "There's no user called", args[0])
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't save the token:", err)
+		return 1
+	}
+	fmt.Printf("Reset token for %s, good once until %s:\n%s\n", args[0], expires.Format(time.RFC1123), token)
+	return 0
+}
+
+//disableTwoFactor - turns two-factor off for a user who can't log in without it any more
+func disableTwoFactor(c *Config, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, "usage: termtexter-server [flags] disable-2fa <username>")
+		return 2
+	}
+	db, err := connect(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer db.Close()
+	id, err := db.GetUserID(args[0])
+	if errors.Is(err, ttdb.ErrNotFound) {
+		fmt.Fprintln(os.Stderr, "There's no user called", args[0])
+		return 1
+	}
+	if err == nil {
+		err = db.DisableTwoFactor(id)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Couldn't turn two-factor off:", err)
+		return 1
+	}
+	fmt.Println("Two-factor is off for", args[0])
+	return 0
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/time/rate"
+)
+
+const (
+	ENV_PREFIX = "TERMTEXTER_"
+)
+
+//Config - everything the server can be told at startup. Starts from defaultConfig, then the config file,
+//then TERMTEXTER_ environment variables, then flags, each one winning over the last
+type Config struct {
+	Listen    listenConfig    `toml:"listen"`
+	DB        dbConfig        `toml:"db"`
+	TLS       tlsConfig       `toml:"tls"`
+	Session   sessionConfig   `toml:"session"`
+	RateLimit rateLimitConfig `toml:"rate_limit"`
+	Login     loginConfig     `toml:"login"`
+	Password  passwordConfig  `toml:"password"`
+	TwoFactor twoFactorConfig `toml:"two_factor"`
+	Log       logConfig       `toml:"log"`
+	Admin     adminConfig     `toml:"admin"`
+	Shutdown  shutdownConfig  `toml:"shutdown"`
+}
+
+type listenConfig struct {
+	TCP           string `toml:"tcp"`            //host:port for raw TCP clients, empty to turn it off
+	WebSocket     string `toml:"websocket"`      //host:port for WebSocket clients, empty to turn it off
+	Unix          string `toml:"unix"`           //socket path for clients on this machine, empty to turn it off
+	PeerCredLogin bool   `toml:"peercred_login"` //log Unix socket clients in as their Unix user, no password needed
+}
+
+type dbConfig struct {
+	Backend string `toml:"backend"` //the database/sql driver, only mysql for now
+	DSN     string `toml:"dsn"`     //in the driver's format. Keep it in the file or the environment, flags show up in ps
+}
+
+type tlsConfig struct {
+	Cert string `toml:"cert"` //PEM files, setting both serves TLS on the TCP and WebSocket listeners
+	Key  string `toml:"key"`
+	tls  *tls.Config
+}
+
+type sessionConfig struct {
+	Lifetime       duration `toml:"lifetime"` //how long a login lasts, 0 for forever
+	HelloTimeout   duration `toml:"hello_timeout"`
+	PingInterval   duration `toml:"ping_interval"`
+	MaxMissedPongs int      `toml:"max_missed_pongs"`
+}
+
+type rateLimitConfig struct {
+	Requests     float64  `toml:"requests"`      //packets a second each connection can keep up, 0 for no limit
+	Burst        int      `toml:"burst"`         //how many it can send at once before the limit kicks in
+	UserRequests float64  `toml:"user_requests"` //the same across all of a user's connections
+	UserBurst    int      `toml:"user_burst"`
+	RoomPosts    float64  `toml:"room_posts"` //messages a second posted to one room, by everyone in it
+	RoomBurst    int      `toml:"room_burst"`
+	MaxStrikes   int      `toml:"max_strikes"`   //rate limited packets in a row before a connection is dropped, 0 for never
+	MaxSlowMode  duration `toml:"max_slow_mode"` //the longest a room admin can turn slow mode on for
+}
+
+type loginConfig struct {
+	FreeAttempts           int      `toml:"free_attempts"` //failed logins in a row before there's a wait
+	BaseDelay              duration `toml:"base_delay"`    //the first wait, doubling with every failure after
+	MaxDelay               duration `toml:"max_delay"`
+	LockoutAttempts        int      `toml:"lockout_attempts"`         //failed logins in a row that lock a username out, 0 for never
+	AddressLockoutAttempts int      `toml:"address_lockout_attempts"` //the same for a remote address, which can be a whole NAT
+	Lockout                duration `toml:"lockout"`
+}
+
+type passwordConfig struct {
+	Cost          int      `toml:"cost"`           //bcrypt cost for new hashes, older weaker ones are redone at login
+	MinLength     int      `toml:"min_length"`     //fewest characters a new password can have
+	MinClasses    int      `toml:"min_classes"`    //how many of lower case, upper case, digits and symbols it needs
+	ResetLifetime duration `toml:"reset_lifetime"` //how long a reset token from the reset command works for
+}
+
+type twoFactorConfig struct {
+	Issuer           string `toml:"issuer"`             //the name authenticator apps list us under
+	RequireForAdmins bool   `toml:"require_for_admins"` //room admins can't make rooms or use admin commands without it
+}
+
+type shutdownConfig struct {
+	Timeout    duration `toml:"timeout"`     //how long to wait on requests in flight and connections to close
+	RetryAfter duration `toml:"retry_after"` //how long clients are told to wait before reconnecting
+}
+
+type adminConfig struct {
+	Listen string `toml:"listen"` //host:port for /metrics, /healthz and /readyz, empty to turn it off. Not for the public network
+}
+
+type logConfig struct {
+	Level  string `toml:"level"`  //debug, info, warn or error
+	Format string `toml:"format"` //text or json
+	File   string `toml:"file"`   //empty for stderr
+}
+
+//duration - a time.Duration that reads like "15s" from the config file, flags and the environment
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+//defaultConfig - what you get without a config file. Everything but the DSN works out of the box
+func defaultConfig() *Config {
+	c := &Config{}
+	c.Listen.TCP = ":1200"
+	c.Listen.WebSocket = ":1201"
+	c.DB.Backend = "mysql"
+	c.Session.HelloTimeout.Duration = HELLO_TIMEOUT
+	c.Session.PingInterval.Duration = PING_INTERVAL
+	c.Session.MaxMissedPongs = MAX_MISSED_PONGS
+	c.RateLimit.Requests = 20
+	c.RateLimit.Burst = 40
+	c.RateLimit.UserRequests = 30
+	c.RateLimit.UserBurst = 60
+	c.RateLimit.RoomPosts = 50
+	c.RateLimit.RoomBurst = 100
+	c.RateLimit.MaxStrikes = 100
+	c.RateLimit.MaxSlowMode.Duration = 24 * time.Hour
+	c.Login.FreeAttempts = 3
+	c.Login.BaseDelay.Duration = time.Second
+	c.Login.MaxDelay.Duration = time.Minute
+	c.Login.LockoutAttempts = 10
+	c.Login.AddressLockoutAttempts = 50
+	c.Login.Lockout.Duration = 15 * time.Minute
+	c.Password.Cost = 12
+	c.Password.MinLength = 10
+	c.Password.MinClasses = 2
+	c.Password.ResetLifetime.Duration = time.Hour
+	c.TwoFactor.Issuer = "termtexter"
+	c.Log.Level = "info"
+	c.Log.Format = "text"
+	c.Admin.Listen = "127.0.0.1:1202"
+	c.Shutdown.Timeout.Duration = 30 * time.Second
+	c.Shutdown.RetryAfter.Duration = 5 * time.Second
+	return c
+}
+
+//flags - every setting as a flag. The environment variable for one is TERMTEXTER_ plus the flag name
+//in upper case with the dots and dashes as underscores, like TERMTEXTER_DB_DSN for -db.dsn
+func (c *Config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen.TCP, "listen.tcp", c.Listen.TCP, "host:port to listen for TCP clients on, empty to turn it off")
+	fs.StringVar(&c.Listen.WebSocket, "listen.websocket", c.Listen.WebSocket, "host:port to listen for WebSocket clients on, empty to turn it off")
+	fs.StringVar(&c.Listen.Unix, "listen.unix", c.Listen.Unix, "Unix socket to listen on for local clients, empty to turn it off")
+	fs.BoolVar(&c.Listen.PeerCredLogin, "listen.peercred-login", c.Listen.PeerCredLogin, "log Unix socket clients in as their Unix user")
+	fs.StringVar(&c.DB.Backend, "db.backend", c.DB.Backend, "database driver, only mysql for now")
+	fs.StringVar(&c.DB.DSN, "db.dsn", c.DB.DSN, "database DSN. Anyone on the host can see flags in ps, use the config file or "+envName("db.dsn")+" instead")
+	fs.StringVar(&c.TLS.Cert, "tls.cert", c.TLS.Cert, "PEM certificate to serve TLS with")
+	fs.StringVar(&c.TLS.Key, "tls.key", c.TLS.Key, "PEM key for the certificate")
+	fs.Var(&c.Session.Lifetime, "session.lifetime", "how long a login lasts, 0 for forever")
+	fs.Var(&c.Session.HelloTimeout, "session.hello-timeout", "how long a new connection has to say hello")
+	fs.Var(&c.Session.PingInterval, "session.ping-interval", "how often to ping a quiet connection")
+	fs.IntVar(&c.Session.MaxMissedPongs, "session.max-missed-pongs", c.Session.MaxMissedPongs, "unanswered pings before a connection is dropped")
+	fs.Float64Var(&c.RateLimit.Requests, "rate-limit.requests", c.RateLimit.Requests, "packets a second each connection can keep up, 0 for no limit")
+	fs.IntVar(&c.RateLimit.Burst, "rate-limit.burst", c.RateLimit.Burst, "packets a connection can send at once before the limit kicks in")
+	fs.Float64Var(&c.RateLimit.UserRequests, "rate-limit.user-requests", c.RateLimit.UserRequests, "packets a second each user can keep up across their connections, 0 for no limit")
+	fs.IntVar(&c.RateLimit.UserBurst, "rate-limit.user-burst", c.RateLimit.UserBurst, "packets a user can send at once before the limit kicks in")
+	fs.Float64Var(&c.RateLimit.RoomPosts, "rate-limit.room-posts", c.RateLimit.RoomPosts, "messages a second that can be posted to one room, 0 for no limit")
+	fs.IntVar(&c.RateLimit.RoomBurst, "rate-limit.room-burst", c.RateLimit.RoomBurst, "messages that can be posted to a room at once before the limit kicks in")
+	fs.IntVar(&c.RateLimit.MaxStrikes, "rate-limit.max-strikes", c.RateLimit.MaxStrikes, "rate limited packets in a row before a connection is dropped, 0 for never")
+	fs.Var(&c.RateLimit.MaxSlowMode, "rate-limit.max-slow-mode", "the longest a room admin can turn slow mode on for")
+	fs.IntVar(&c.Login.FreeAttempts, "login.free-attempts", c.Login.FreeAttempts, "failed logins in a row before there's a wait")
+	fs.Var(&c.Login.BaseDelay, "login.base-delay", "the first wait after failed logins, doubling with every failure after")
+	fs.Var(&c.Login.MaxDelay, "login.max-delay", "the longest wait between failed logins")
+	fs.IntVar(&c.Login.LockoutAttempts, "login.lockout-attempts", c.Login.LockoutAttempts, "failed logins in a row that lock a username out, 0 for never")
+	fs.IntVar(&c.Login.AddressLockoutAttempts, "login.address-lockout-attempts", c.Login.AddressLockoutAttempts, "failed logins in a row that lock a remote address out, 0 for never")
+	fs.Var(&c.Login.Lockout, "login.lockout", "how long a lockout lasts")
+	fs.IntVar(&c.Password.Cost, "password.cost", c.Password.Cost, "bcrypt cost for password hashes")
+	fs.IntVar(&c.Password.MinLength, "password.min-length", c.Password.MinLength, "fewest characters a new password can have")
+	fs.IntVar(&c.Password.MinClasses, "password.min-classes", c.Password.MinClasses, "how many of lower case, upper case, digits and symbols a new password needs")
+	fs.Var(&c.Password.ResetLifetime, "password.reset-lifetime", "how long a reset token from the reset command works for")
+	fs.StringVar(&c.TwoFactor.Issuer, "two-factor.issuer", c.TwoFactor.Issuer, "the name authenticator apps list this server under")
+	fs.BoolVar(&c.TwoFactor.RequireForAdmins, "two-factor.require-for-admins", c.TwoFactor.RequireForAdmins, "room admins need two-factor on to make rooms or use admin commands")
+	fs.StringVar(&c.Log.Level, "log.level", c.Log.Level, "debug, info, warn or error")
+	fs.StringVar(&c.Log.Format, "log.format", c.Log.Format, "text or json")
+	fs.StringVar(&c.Log.File, "log.file", c.Log.File, "file to log to, empty for stderr")
+	fs.StringVar(&c.Admin.Listen, "admin.listen", c.Admin.Listen, "host:port to serve /metrics, /healthz and /readyz on, empty to turn it off")
+	fs.Var(&c.Shutdown.Timeout, "shutdown.timeout", "how long to wait on requests in flight and connections to close when shutting down")
+	fs.Var(&c.Shutdown.RetryAfter, "shutdown.retry-after", "how long clients are told to wait before reconnecting after a shutdown")
+}
+
+//envName - the environment variable for a flag
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flagName))
+}
+
+//loadConfig - works out the config from the defaults, the config file, the environment and args, in that order.
+//Every problem found is in the returned error, not just the first. Whatever is left after the flags is returned, for commands
+func loadConfig(args []string) (*Config, []string, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("termtexter-server", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(envName("config")), "TOML config file")
+	c.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	//the flags they gave have to win over the file and environment, so remember them to set again after
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	if *path != "" {
+		md, err := toml.DecodeFile(*path, c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("config file %s: %w", *path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, nil, fmt.Errorf("config file %s: unknown settings %v", *path, undecoded)
+		}
+	}
+
+	errs := make([]error, 0)
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if v, ok := os.LookupEnv(envName(f.Name)); ok {
+			if err := f.Value.Set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", envName(f.Name), err))
+			}
+		}
+	})
+	for name, v := range given {
+		fs.Set(name, v)
+	}
+
+	errs = append(errs, c.validate()...)
+	return c, fs.Args(), errors.Join(errs...)
+}
+
+//validate - everything wrong with the config, so it can all be fixed in one go
+func (c *Config) validate() []error {
+	errs := make([]error, 0)
+	bad := func(format string, a ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, a...))
+	}
+
+	if c.Listen.TCP == "" && c.Listen.WebSocket == "" && c.Listen.Unix == "" {
+		bad("listen: nothing to listen on, set at least one of tcp, websocket or unix")
+	}
+	for name, addr := range map[string]string{"listen.tcp": c.Listen.TCP, "listen.websocket": c.Listen.WebSocket, "admin.listen": c.Admin.Listen} {
+		if addr == "" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			bad("%s: %v", name, err)
+		}
+	}
+	if c.Listen.PeerCredLogin && c.Listen.Unix == "" {
+		bad("listen.peercred_login: only works with a unix socket")
+	}
+
+	if c.DB.Backend != "mysql" {
+		bad("db.backend: %q isn't supported, only mysql is", c.DB.Backend)
+	}
+	if c.DB.DSN == "" {
+		bad("db.dsn: required, like termtexter:password@tcp(localhost)/termtexter?parseTime=true")
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		bad("tls: cert and key have to be set together")
+	} else if c.TLS.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
+		if err != nil {
+			bad("tls: %v", err)
+		} else {
+			c.TLS.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+	}
+
+	if c.Session.Lifetime.Duration < 0 {
+		bad("session.lifetime: can't be negative")
+	}
+	if c.Session.HelloTimeout.Duration <= 0 {
+		bad("session.hello_timeout: has to be more than 0")
+	}
+	if c.Session.PingInterval.Duration <= 0 {
+		bad("session.ping_interval: has to be more than 0")
+	}
+	if c.Session.MaxMissedPongs < 1 {
+		bad("session.max_missed_pongs: has to be at least 1")
+	}
+
+	for _, l := range []struct {
+		name  string
+		limit float64
+		burst int
+	}{{"requests", c.RateLimit.Requests, c.RateLimit.Burst}, {"user_requests", c.RateLimit.UserRequests, c.RateLimit.UserBurst},
+		{"room_posts", c.RateLimit.RoomPosts, c.RateLimit.RoomBurst}} {
+		if l.limit < 0 {
+			bad("rate_limit.%s: can't be negative", l.name)
+		}
+		if l.limit > 0 && l.burst < 1 {
+			bad("rate_limit: the burst for %s has to be at least 1 when there's a limit", l.name)
+		}
+	}
+	if c.RateLimit.MaxStrikes < 0 {
+		bad("rate_limit.max_strikes: can't be negative")
+	}
+	if c.RateLimit.MaxSlowMode.Duration < 0 {
+		bad("rate_limit.max_slow_mode: can't be negative")
+	}
+
+	if c.Login.FreeAttempts < 0 {
+		bad("login.free_attempts: can't be negative")
+	}
+	if c.Login.BaseDelay.Duration < 0 {
+		bad("login.base_delay: can't be negative")
+	}
+	if c.Login.MaxDelay.Duration < c.Login.BaseDelay.Duration {
+		bad("login.max_delay: can't be less than base_delay")
+	}
+	if c.Login.LockoutAttempts < 0 {
+		bad("login.lockout_attempts: can't be negative")
+	}
+	if c.Login.AddressLockoutAttempts < 0 {
+		bad("login.address_lockout_attempts: can't be negative")
+	}
+	if (c.Login.LockoutAttempts > 0 || c.Login.AddressLockoutAttempts > 0) && c.Login.Lockout.Duration <= 0 {
+		bad("login.lockout: has to be more than 0 when there are lockouts")
+	}
+
+	if c.Password.Cost < bcrypt.MinCost || c.Password.Cost > bcrypt.MaxCost {
+		bad("password.cost: has to be from %d to %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+	if c.Password.MinLength < 1 || c.Password.MinLength > PASSWORD_MAX_LENGTH {
+		bad("password.min_length: has to be from 1 to %d", PASSWORD_MAX_LENGTH)
+	}
+	if c.Password.MinClasses < 1 || c.Password.MinClasses > 4 {
+		bad("password.min_classes: has to be from 1 to 4")
+	}
+	if c.Password.ResetLifetime.Duration <= 0 {
+		bad("password.reset_lifetime: has to be more than 0")
+	}
+	if c.TwoFactor.Issuer == "" || strings.Contains(c.TwoFactor.Issuer, ":") {
+		bad("two_factor.issuer: can't be empty or have a : in it")
+	}
+
+	if c.Shutdown.Timeout.Duration <= 0 {
+		bad("shutdown.timeout: has to be more than 0")
+	}
+	if c.Shutdown.RetryAfter.Duration < 0 {
+		bad("shutdown.retry_after: can't be negative")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		bad("log.level: %q isn't one of debug, info, warn or error", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		bad("log.format: %q isn't text or json", c.Log.Format)
+	}
+	return errs
+}
+
+//setupLogging - points the log package (and slog) at the configured file, format and level
+func (lc logConfig) setupLogging() error {
+	var w io.Writer = os.Stderr
+	if lc.File != "" {
+		f, err := os.OpenFile(lc.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+		w = f
+	}
+	var level slog.Level
+	level.UnmarshalText([]byte(lc.Level))
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(w, opts)
+	if lc.Format == "json" {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+//configure - sets the server up from a validated config
+func (s *Server) configure(c *Config) error {
+	if err := c.Log.setupLogging(); err != nil {
+		return err
+	}
+	s.TCPAddr = c.Listen.TCP
+	s.WebSocketAddr = c.Listen.WebSocket
+	s.UnixSocket = c.Listen.Unix
+	s.PeerCredLogin = c.Listen.PeerCredLogin
+	s.AdminAddr = c.Admin.Listen
+	s.DBBackend = c.DB.Backend
+	s.DBDSN = c.DB.DSN
+	s.TLS = c.TLS.tls
+	s.db.SessionLifetime = c.Session.Lifetime.Duration
+	s.HelloTimeout = c.Session.HelloTimeout.Duration
+	s.PingInterval = c.Session.PingInterval.Duration
+	s.MaxMissedPongs = c.Session.MaxMissedPongs
+	s.RateLimit = rate.Limit(c.RateLimit.Requests)
+	s.RateBurst = c.RateLimit.Burst
+	s.UserRateLimit = rate.Limit(c.RateLimit.UserRequests)
+	s.UserRateBurst = c.RateLimit.UserBurst
+	s.RoomRateLimit = rate.Limit(c.RateLimit.RoomPosts)
+	s.RoomRateBurst = c.RateLimit.RoomBurst
+	s.MaxStrikes = c.RateLimit.MaxStrikes
+	s.MaxSlowMode = c.RateLimit.MaxSlowMode.Duration
+	s.LoginFreeAttempts = c.Login.FreeAttempts
+	s.LoginBaseDelay = c.Login.BaseDelay.Duration
+	s.LoginMaxDelay = c.Login.MaxDelay.Duration
+	s.LoginLockoutAttempts = c.Login.LockoutAttempts
+	s.LoginAddressLockoutAttempts = c.Login.AddressLockoutAttempts
+	s.LoginLockout = c.Login.Lockout.Duration
+	s.db.BcryptCost = c.Password.Cost
+	s.PasswordMinLength = c.Password.MinLength
+	s.PasswordMinClasses = c.Password.MinClasses
+	s.TwoFactorIssuer = c.TwoFactor.Issuer
+	s.TwoFactorAdmins = c.TwoFactor.RequireForAdmins
+	s.ShutdownTimeout = c.Shutdown.Timeout.Duration
+	s.RetryAfter = c.Shutdown.RetryAfter.Duration
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//writeConfig - a TOML config file with these contents, cleaned up after the test
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "termtexter.toml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+[listen]
+tcp = "127.0.0.1:1000"
+websocket = "127.0.0.1:1001"
+
+[db]
+dsn = "from-file"
+
+[login]
+free_attempts = 5
+base_delay = "2s"
+
+[log]
+level = "warn"
+`)
+	t.Setenv(envName("config"), path)
+	t.Setenv(envName("listen.websocket"), "127.0.0.1:2001")
+	t.Setenv(envName("login.free-attempts"), "6")
+	t.Setenv(envName("db.dsn"), "from-env")
+
+	c, args, err := loadConfig([]string{"-listen.websocket", "127.0.0.1:3001", "-db.dsn", "from-flag", "reset", "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		got  interface{}
+		want interface{}
+	}{
+		{"default, nothing set", c.Shutdown.Timeout.Duration, 30 * time.Second},
+		{"file over the default", c.Listen.TCP, "127.0.0.1:1000"},
+		{"file over the default, duration", c.Login.BaseDelay.Duration, 2 * time.Second},
+		{"file only", c.Log.Level, "warn"},
+		{"env over the file", c.Login.FreeAttempts, 6},
+		{"flag over env and file", c.Listen.WebSocket, "127.0.0.1:3001"},
+		{"flag over env and file, string", c.DB.DSN, "from-flag"},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if strings.Join(args, " ") != "reset alice" {
+		t.Errorf("args left after the flags = %q, want the command", args)
+	}
+}
+
+func TestLoadConfigFileFlag(t *testing.T) {
+	//-config wins over TERMTEXTER_CONFIG like every other flag
+	t.Setenv(envName("config"), writeConfig(t, "[db]\ndsn = \"env-file\"\n"))
+	c, _, err := loadConfig([]string{"-config", writeConfig(t, "[db]\ndsn = \"flag-file\"\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DB.DSN != "flag-file" {
+		t.Errorf("db.dsn = %q, want the one from the -config file", c.DB.DSN)
+	}
+}
+
+func TestLoadConfigUnknownSetting(t *testing.T) {
+	path := writeConfig(t, "[db]\ndsn = \"x\"\nbackend_typo = \"mysql\"\n")
+	if _, _, err := loadConfig([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "backend_typo") {
+		t.Errorf("err = %v, want the unknown setting named", err)
+	}
+}
+
+func TestLoadConfigEveryError(t *testing.T) {
+	path := writeConfig(t, `
+[db]
+backend = "sqlite"
+
+[session]
+max_missed_pongs = 0
+
+[password]
+cost = 100
+
+[log]
+format = "xml"
+`)
+	t.Setenv(envName("login.free-attempts"), "lots")
+	_, _, err := loadConfig([]string{"-config", path, "-login.base-delay", "1m", "-login.max-delay", "1s"})
+	if err == nil {
+		t.Fatal("a config with every one of these wrong was accepted")
+	}
+	for _, want := range []string{
+		envName("login.free-attempts"),
+		"db.backend",
+		"db.dsn",
+		"session.max_missed_pongs",
+		"password.cost",
+		"log.format",
+		"login.max_delay",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't mention %s:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidateDefaults(t *testing.T) {
+	c := defaultConfig()
+	c.DB.DSN = "termtexter:password@tcp(localhost)/termtexter?parseTime=true"
+	if errs := c.validate(); len(errs) != 0 {
+		t.Errorf("the defaults with a DSN should be fine, got %v", errs)
+	}
+	//and the only thing missing from the defaults is the DSN
+	if errs := defaultConfig().validate(); len(errs) != 1 || !strings.Contains(errs[0].Error(), "db.dsn") {
+		t.Errorf("defaults without a DSN: got %v, want just the db.dsn error", errs)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"runtime/debug"
+	"time"
+
+	proto "termtexter/proto"
+)
+
+//requestError - a request failed because of something on the client's end. It goes back to them as a proto.Error as it is
+type requestError struct {
+	Code    int
+	Reason  string //one of the proto.ERR_ constants
+	Message string
+	Field   string
+	//for ERR_RATE_LIMITED, how long until they can try again
+	RetryAfter time.Duration
+}
+
+func (e *requestError) Error() string {
+	return e.Message
+}
+
+//badRequest - the request itself was wrong, like an empty field
+func badRequest(reason string, message string, field string) error {
+	return &requestError{Code: HTTP_BADREQUEST, Reason: reason, Message: message, Field: field}
+}
+
+//forbidden - they aren't allowed to do that, like with a bad password or an expired session
+func forbidden(reason string, message string, field string) error {
+	return &requestError{Code: HTTP_FORBIDDEN, Reason: reason, Message: message, Field: field}
+}
+
+//rateLimited - they're going too fast, and can try again after wait
+func rateLimited(message string, wait time.Duration) error {
+	return &requestError{Code: HTTP_TOO_MANY, Reason: proto.ERR_RATE_LIMITED, Message: message, RetryAfter: wait}
+}
+
+//errLoggedIn - a connection is one user for its whole life, so the registry and hub never hold a stale identity for it
+var errLoggedIn = badRequest(proto.ERR_LOGGED_IN, "This connection is already logged in", "")
+
+//errBadLogin - the same for an unknown username and a wrong password, so nobody can fish for usernames
+var errBadLogin = forbidden(proto.ERR_BAD_LOGIN, "Incorrect username or password", proto.FIELD_PASSWORD)
+
+//respond - tells the client a request failed. A requestError goes back as it is, anything else is our fault,
+//so it's logged and they only hear that something went wrong
+func (s *Server) respond(p *proto.Proto, lg *slog.Logger, msg interface{}, err error) {
+	rid := proto.RequestIDOf(msg)
+	var re *requestError
+	if errors.As(err, &re) {
+		lg.Debug("Request refused", "code", re.Code, "reason", re.Reason)
+		switch re.Reason {
+		case proto.ERR_RATE_LIMITED:
+			p.SendRateLimited(rid, re.Message, re.RetryAfter)
+			return
+		case proto.ERR_LOCKED:
+			switch msg.(type) {
+			case proto.Login, proto.TwoFactorLogin:
+				//logins get their own answer
+				p.SendLoginLocked(rid, re.Message, re.RetryAfter)
+			default:
+				//everything else gets an Error, a LoginResponse would look like it worked
+				p.SendLocked(rid, re.Message, re.RetryAfter)
+			}
+			return
+		}
+		p.SendError(rid, re.Code, re.Reason, re.Message, re.Field)
+		return
+	}
+	lg.Error("Request failed", "err", err)
+	p.SendError(rid, HTTP_ERROR, proto.ERR_INTERNAL, "Something went wrong on our end, try again", "")
+}
+
+//dispatch - hands a packet to its handler. A panic in there only costs this one request: it's logged, the client
+//gets a 500, and the connection (and everyone else) carries on. id is updated when they log in
+func (s *Server) dispatch(msg interface{}, p *proto.Proto, peer string, id *int) {
+	typ := proto.TypeOf(msg)
+	lg := s.log(p).With("request", typ, "request_id", proto.RequestIDOf(msg))
+	start := time.Now()
+	var err error
+	defer func() {
+		res := result(err)
+		if r := recover(); r != nil {
+			lg.Error("Panic handling request", "panic", r, "stack", string(debug.Stack()))
+			p.SendError(proto.RequestIDOf(msg), HTTP_ERROR, proto.ERR_INTERNAL, "Something went wrong on our end, try again", "")
+			res = RESULT_PANIC
+		}
+		s.metrics.request(typ, res, time.Since(start))
+		lg.Debug("Handled request", "result", res, "took", time.Since(start))
+	}()
+	//based on the message type, take different actions
+	switch msg := msg.(type) {
+	case proto.Login:
+		if *id != -1 {
+			err = errLoggedIn
+			break
+		}
+		var uid int
+		//-1 with no error is a two-factor challenge, they aren't in yet
+		if uid, err = s.handleLogin(msg, p, peer); err == nil && uid >= 0 {
+			*id = uid
+			s.loggedIn(p, uid)
+		}
+	case proto.TwoFactorLogin:
+		if *id != -1 {
+			err = errLoggedIn
+			break
+		}
+		var uid int
+		if uid, err = s.handleTwoFactorLogin(msg, p); err == nil {
+			*id = uid
+			s.loggedIn(p, uid)
+		}
+	case proto.ResumeRequest:
+		if *id != -1 {
+			err = errLoggedIn
+			break
+		}
+		var uid int
+		if uid, err = s.handleResume(msg, p); err == nil {
+			*id = uid
+			s.loggedIn(p, uid)
+		}
+	case proto.Message:
+		err = s.handleMessage(msg, p)
+	case proto.Register:
+		err = s.handleRegistration(msg, p)
+	case proto.JoinRoomRequest:
+		err = s.handleJoinRoom(msg, p)
+	case proto.CreateRoomRequest:
+		err = s.handleCreateRoom(msg, p)
+	case proto.LeaveRoomRequest:
+		err = s.handleLeaveRoom(msg, p)
+	case proto.GetRoomsRequest:
+		err = s.handleGetRooms(msg, p)
+	case proto.GetMessagesRequest:
+		err = s.handleGetMessages(msg, p)
+	case proto.PostMessageRequest:
+		err = s.handlePostMessage(msg, p)
+	case proto.SlowModeRequest:
+		err = s.handleSlowMode(msg, p)
+	case proto.ChangePasswordRequest:
+		err = s.handleChangePassword(msg, p)
+	case proto.ResetPasswordRequest:
+		err = s.handleResetPassword(msg, p)
+	case proto.TwoFactorSetupRequest:
+		err = s.handleTwoFactorSetup(msg, p)
+	case proto.TwoFactorEnableRequest:
+		err = s.handleTwoFactorEnable(msg, p)
+	case proto.TwoFactorDisableRequest:
+		err = s.handleTwoFactorDisable(msg, p)
+	case proto.Ping:
+		err = p.SendPong()
+	case proto.Pong:
+		//nothing to do, hearing from them at all is enough
+	default:
+		//let them know we aren't going to do anything with it
+		r := reflect.TypeOf(msg)
+		err = badRequest(proto.ERR_UNKNOWN_TYPE, fmt.Sprintf("Unexpected packet %v", r), "")
+	}
+	if err != nil {
+		s.respond(p, lg, msg, err)
+	}
+}
+
+//log - the logger for a connection, with its conn id and (once they log in) user id on every line
+func (s *Server) log(p *proto.Proto) *slog.Logger {
+	return s.live.logger(p)
+}
+
+//loggedIn - puts the user id on the connection's log lines from now on
+func (s *Server) loggedIn(p *proto.Proto, id int) {
+	lg := s.log(p)
+	s.live.setLogger(p, lg.With("user", id))
+	lg.Info("Logged in", "user", id)
+}
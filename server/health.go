@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HEALTHZ_PATH  = "/healthz"
+	READYZ_PATH   = "/readyz"
+	READY_TIMEOUT = 2 * time.Second //how long /readyz waits on the DB before calling it down
+)
+
+//healthz - the process is up and serving HTTP. A supervisor should only restart us when this fails
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+//readyz - we can take clients right now: the listeners are accepting and the DB answers. An orchestrator should
+//only send clients our way while this passes. It fails for good once Shutdown starts
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	problems := make([]string, 0)
+	if !s.accepting() {
+		problems = append(problems, "listeners: not accepting connections")
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), READY_TIMEOUT)
+	defer cancel()
+	if err := s.db.Ping(ctx); err != nil {
+		problems = append(problems, "db: "+err.Error())
+	}
+	if len(problems) > 0 {
+		w.WriteHeader(HTTP_UNAVAILABLE)
+		fmt.Fprintln(w, strings.Join(problems, "\n"))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+//accepting - true from when Init starts serving until Shutdown starts
+func (s *Server) accepting() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.serving && !s.closing
+}
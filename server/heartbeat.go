@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	proto "termtexter/proto"
+)
+
+const (
+	PING_INTERVAL    = 15 * time.Second
+	MAX_MISSED_PONGS = 3
+)
+
+//heartbeat - keeps track of when we last heard from a connection
+type heartbeat struct {
+	last int64 //unix nanoseconds of the last packet we read
+}
+
+//seen - call this every time a packet comes in on the connection
+func (h *heartbeat) seen() {
+	atomic.StoreInt64(&h.last, time.Now().UnixNano())
+}
+
+//idle - how long it's been since the connection sent us anything
+func (h *heartbeat) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&h.last)))
+}
+
+//idleTimeout - how long any connection can go without sending us anything before it's dropped. That's as many
+//pings as it's allowed to miss, so a client that answers them is never idle for this long
+func (s *Server) idleTimeout() time.Duration {
+	return s.PingInterval * time.Duration(s.MaxMissedPongs+1)
+}
+
+//timedOut - whether a read failed because the connection was quiet for idleTimeout
+func timedOut(err error) bool {
+	var ne net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) ||
+		(errors.As(err, &ne) && ne.Timeout())
+}
+
+//keepAlive - pings a connection that supports it whenever it goes quiet, so a live client always has something to
+//answer before its idleTimeout runs out. Dropping the ones that don't is the read deadline's job, not this
+func (s *Server) keepAlive(p *proto.Proto, hb *heartbeat, done chan struct{}) {
+	ticker := time.NewTicker(s.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if hb.idle() >= s.PingInterval {
+				p.SendPing()
+			}
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	proto "termtexter/proto"
+)
+
+//hub - room based pub/sub for messages. Each connection subscribes to the rooms its user is a member of,
+//and a post to a room is handed to every subscribed connection exactly once
+type hub struct {
+	mu    sync.RWMutex
+	rooms map[int]map[*proto.Proto]bool //room id to the connections subscribed to it
+	//connection to the rooms it's subscribed to, so it can be dropped in one go. A connection is in here from add
+	//until drop, even with no rooms, and only those can be subscribed
+	subs  map[*proto.Proto]map[int]bool
+	stats deliveryStats
+}
+
+//deliveryStats - how fan-out is doing, exported in metrics.go. Latency is from when the server read the post to when it
+//was queued for a connection
+type deliveryStats struct {
+	posts      int64
+	deliveries int64
+	failed     int64
+	latency    int64 //total nanoseconds, divide by deliveries for the average
+	maxLatency int64
+}
+
+//add - a newly logged in connection, subscribed to these rooms. Call it from the connection's own goroutine,
+//so it can't come after drop
+func (h *hub) add(p *proto.Proto, rooms ...int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms == nil {
+		h.rooms = make(map[int]map[*proto.Proto]bool)
+		h.subs = make(map[*proto.Proto]map[int]bool)
+	}
+	if h.subs[p] == nil {
+		h.subs[p] = make(map[int]bool)
+	}
+	h.subscribeLocked(p, rooms)
+}
+
+//subscribe - start sending a connection the messages posted in these rooms. A connection that was dropped (or never
+//added) is ignored, it may have been looked up just before it went away and would never be cleaned up again
+func (h *hub) subscribe(p *proto.Proto, rooms ...int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[p] == nil {
+		return
+	}
+	h.subscribeLocked(p, rooms)
+}
+
+func (h *hub) subscribeLocked(p *proto.Proto, rooms []int) {
+	for _, rid := range rooms {
+		if h.rooms[rid] == nil {
+			h.rooms[rid] = make(map[*proto.Proto]bool)
+		}
+		h.rooms[rid][p] = true
+		h.subs[p][rid] = true
+	}
+}
+
+//unsubscribe - stop sending a connection the messages posted in a room
+func (h *hub) unsubscribe(p *proto.Proto, rid int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unsubscribeLocked(p, rid)
+}
+
+func (h *hub) unsubscribeLocked(p *proto.Proto, rid int) {
+	delete(h.rooms[rid], p)
+	if len(h.rooms[rid]) == 0 {
+		delete(h.rooms, rid)
+	}
+	delete(h.subs[p], rid)
+}
+
+//drop - unsubscribes a connection from everything, for when it goes away
+func (h *hub) drop(p *proto.Proto) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for rid := range h.subs[p] {
+		h.unsubscribeLocked(p, rid)
+	}
+	delete(h.subs, p)
+}
+
+//publish - hands a message to every connection subscribed to the room. received is when the server read the post
+func (h *hub) publish(rid int, dm *proto.DynamicMessage, received time.Time) {
+	//copy the subscribers so slow sends don't hold the lock
+	h.mu.RLock()
+	subscribers := make([]*proto.Proto, 0, len(h.rooms[rid]))
+	for p := range h.rooms[rid] {
+		subscribers = append(subscribers, p)
+	}
+	h.mu.RUnlock()
+
+	atomic.AddInt64(&h.stats.posts, 1)
+	for _, p := range subscribers {
+		if err := p.SendDynamicMessage(dm); err != nil {
+			//the connection is on its way out, handleClient will clean it up
+			atomic.AddInt64(&h.stats.failed, 1)
+			continue
+		}
+		h.stats.observe(time.Since(received))
+	}
+}
+
+//observe - records one delivery
+func (ds *deliveryStats) observe(latency time.Duration) {
+	atomic.AddInt64(&ds.deliveries, 1)
+	atomic.AddInt64(&ds.latency, int64(latency))
+	for {
+		max := atomic.LoadInt64(&ds.maxLatency)
+		if int64(latency) <= max || atomic.CompareAndSwapInt64(&ds.maxLatency, max, int64(latency)) {
+			return
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	proto "termtexter/proto"
+)
+
+func TestHubConcurrent(t *testing.T) {
+	var h hub
+	const rooms, conns, posts = 4, 16, 50
+	ps := make([]*proto.Proto, conns)
+	for i := range ps {
+		ps[i] = testConn(t)
+	}
+	var wg sync.WaitGroup
+	for i, p := range ps {
+		wg.Add(1)
+		go func(i int, p *proto.Proto) {
+			defer wg.Done()
+			h.add(p, i%rooms)
+			h.subscribe(p, (i+1)%rooms)
+			h.unsubscribe(p, (i+1)%rooms)
+			h.drop(p)
+		}(i, p)
+	}
+	for rid := 0; rid < rooms; rid++ {
+		wg.Add(1)
+		go func(rid int) {
+			defer wg.Done()
+			for n := 0; n < posts; n++ {
+				h.publish(rid, &proto.DynamicMessage{Room: rid, Message: "hi"}, time.Now())
+			}
+		}(rid)
+	}
+	wg.Wait()
+	if got := atomic.LoadInt64(&h.stats.posts); got != rooms*posts {
+		t.Errorf("posts = %d, want %d", got, rooms*posts)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.rooms) != 0 || len(h.subs) != 0 {
+		t.Errorf("subscriptions left after every connection dropped: rooms %v, subs %d", h.rooms, len(h.subs))
+	}
+}
+
+func TestHubDeliversOncePerConnection(t *testing.T) {
+	var h hub
+	p1, p2 := testConn(t), testConn(t)
+	h.add(p1, 1, 2)
+	h.add(p2, 2)
+	h.subscribe(p2, 2) //twice is still once
+	h.publish(2, &proto.DynamicMessage{Room: 2}, time.Now())
+	if got := atomic.LoadInt64(&h.stats.deliveries); got != 2 {
+		t.Errorf("deliveries = %d, want 2", got)
+	}
+	h.drop(p1)
+	h.publish(1, &proto.DynamicMessage{Room: 1}, time.Now())
+	if got := atomic.LoadInt64(&h.stats.deliveries); got != 2 {
+		t.Errorf("deliveries after dropping the only subscriber = %d, want 2", got)
+	}
+}
+
+func TestHubNoSubscribeAfterDrop(t *testing.T) {
+	var h hub
+	p := testConn(t)
+	h.add(p, 1)
+	//another connection's join looked p up just before it went away, and subscribes it just after
+	h.drop(p)
+	h.subscribe(p, 2)
+	h.publish(2, &proto.DynamicMessage{Room: 2}, time.Now())
+	if got := atomic.LoadInt64(&h.stats.deliveries); got != 0 {
+		t.Errorf("deliveries to a dropped connection = %d, want 0", got)
+	}
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if len(h.rooms) != 0 || len(h.subs) != 0 {
+		t.Errorf("dropped connection is still in the hub: rooms %v, subs %d", h.rooms, len(h.subs))
+	}
+}
+
+func TestHubNeverAdded(t *testing.T) {
+	var h hub
+	p := testConn(t)
+	h.subscribe(p, 1)
+	h.publish(1, &proto.DynamicMessage{Room: 1}, time.Now())
+	if got := atomic.LoadInt64(&h.stats.deliveries); got != 0 {
+		t.Errorf("deliveries to a connection that never logged in = %d, want 0", got)
+	}
+}
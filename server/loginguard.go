@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	ttdb "termtexter/db"
+	proto "termtexter/proto"
+)
+
+const (
+	ATTEMPTS_FORGET = time.Hour //an address with no failed logins for this long starts over
+)
+
+//Brute force protection for logins. Failures are counted per username (in the database, so a restart doesn't
+//forgive them) and per address (in memory). The first LoginFreeAttempts failures in a row cost nothing, after that
+//each one doubles the wait before the next try, starting at LoginBaseDelay and topping out at LoginMaxDelay.
+//Enough failures in a row locks the username or address out for LoginLockout
+
+//loginWait - how long until a gets another try. locked is true if that is because of a lockout
+func (s *Server) loginWait(a ttdb.LoginAttempts, now time.Time) (wait time.Duration, locked bool) {
+	if now.Before(a.LockedUntil) {
+		return a.LockedUntil.Sub(now), true
+	}
+	if a.Failures < s.LoginFreeAttempts || s.LoginBaseDelay <= 0 {
+		return 0, false
+	}
+	delay := s.LoginBaseDelay
+	for i := s.LoginFreeAttempts; i < a.Failures && delay < s.LoginMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.LoginMaxDelay {
+		delay = s.LoginMaxDelay
+	}
+	if wait := a.Last.Add(delay).Sub(now); wait > 0 {
+		return wait, false
+	}
+	return 0, false
+}
+
+//loginFailed - a with one more failure, locked out if that makes lockoutAt in a row (0 never locks).
+//Only for the in-memory address counts, usernames are counted by the database so logins at the same time all count
+func (s *Server) loginFailed(a ttdb.LoginAttempts, lockoutAt int, now time.Time) ttdb.LoginAttempts {
+	a.Failures++
+	a.Last = now
+	if lockoutAt > 0 && a.Failures >= lockoutAt {
+		a.LockedUntil = now.Add(s.LoginLockout)
+		a.Failures = 0
+	}
+	return a
+}
+
+//loginRefused - the error for someone who has to wait before trying again, nil if they don't
+func loginRefused(wait time.Duration, locked bool) error {
+	switch {
+	case locked:
+		return &requestError{Code: proto.HTTP_LOCKED, Reason: proto.ERR_LOCKED, RetryAfter: wait,
+			Message: fmt.Sprintf("Too many failed logins, try again in %v", wait.Round(time.Second))}
+	case wait > 0:
+		return rateLimited(fmt.Sprintf("Too many failed logins, wait %v before trying again", wait.Round(time.Second)), wait)
+	}
+	return nil
+}
+
+//userFailed - counts a failed login against a user, returning what they're up to. The count is bumped by the
+//database, so guesses at the same time can't all read the same count and only add one between them
+func (s *Server) userFailed(uid string, now time.Time) (ttdb.LoginAttempts, error) {
+	return s.db.AddFailedLogin(uid, now, s.LoginLockoutAttempts, now.Add(s.LoginLockout))
+}
+
+//addressFailed - counts a failed login against an address, returning what it's up to
+func (s *Server) addressFailed(addr string, now time.Time) ttdb.LoginAttempts {
+	return s.addrAttempts.fail(addr, func(a ttdb.LoginAttempts) ttdb.LoginAttempts {
+		return s.loginFailed(a, s.LoginAddressLockoutAttempts, now)
+	})
+}
+
+//remoteAddress - the address failed logins are counted against. On a Unix socket that is the peer's uid, so one
+//local user guessing can't lock out every other one. Where the kernel won't say, they all share one
+func remoteAddress(p *proto.Proto) string {
+	addr := p.Conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	if addr == "" || addr == "@" {
+		if uid := peerUID(p.Conn); uid != "" {
+			return "uid:" + uid
+		}
+		return "local"
+	}
+	return addr
+}
+
+//addressAttempts - failed logins by remote address
+type addressAttempts struct {
+	mu       sync.Mutex
+	attempts map[string]ttdb.LoginAttempts
+	swept    time.Time
+}
+
+func (aa *addressAttempts) get(addr string) ttdb.LoginAttempts {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	return aa.attempts[addr]
+}
+
+//fail - updates the failed logins for an address with failed, all under the lock so two failures at once both count
+func (aa *addressAttempts) fail(addr string, failed func(ttdb.LoginAttempts) ttdb.LoginAttempts) ttdb.LoginAttempts {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	aa.sweep()
+	a := failed(aa.attempts[addr])
+	aa.attempts[addr] = a
+	return a
+}
+
+//clear - forgets the failed logins for an address
+func (aa *addressAttempts) clear(addr string) {
+	aa.mu.Lock()
+	defer aa.mu.Unlock()
+	delete(aa.attempts, addr)
+}
+
+//sweep - forgets addresses that haven't failed in a while, so the map doesn't grow forever. mu must be held
+func (aa *addressAttempts) sweep() {
+	if aa.attempts == nil {
+		aa.attempts = make(map[string]ttdb.LoginAttempts)
+	}
+	now := time.Now()
+	if now.Sub(aa.swept) > ATTEMPTS_FORGET {
+		for k, v := range aa.attempts {
+			if now.Sub(v.Last) > ATTEMPTS_FORGET && now.After(v.LockedUntil) {
+				delete(aa.attempts, k)
+			}
+		}
+		aa.swept = now
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	ttdb "termtexter/db"
+	proto "termtexter/proto"
+)
+
+func TestLoginWait(t *testing.T) {
+	s := &Server{LoginFreeAttempts: 3, LoginBaseDelay: time.Second, LoginMaxDelay: 8 * time.Second}
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name     string
+		failures int
+		ago      time.Duration //since the last failure
+		locked   time.Duration //until the lockout ends, 0 for none
+		want     time.Duration
+		isLocked bool
+	}{
+		{"no failures", 0, 0, 0, 0, false},
+		{"last free attempt", 2, 0, 0, 0, false},
+		{"first delayed attempt", 3, 0, 0, time.Second, false},
+		{"delay doubles", 4, 0, 0, 2 * time.Second, false},
+		{"and again", 5, 0, 0, 4 * time.Second, false},
+		{"reaches the max", 6, 0, 0, 8 * time.Second, false},
+		{"stays at the max", 7, 0, 0, 8 * time.Second, false},
+		{"far past the max", 60, 0, 0, 8 * time.Second, false},
+		{"part of the delay gone", 4, 500 * time.Millisecond, 0, 1500 * time.Millisecond, false},
+		{"delay just over", 4, 2 * time.Second, 0, 0, false},
+		{"delay long over", 4, time.Hour, 0, 0, false},
+		{"locked out", 0, 0, 5 * time.Minute, 5 * time.Minute, true},
+		{"lockout wins over the delay", 6, 0, time.Second, time.Second, true},
+	}
+	for _, tt := range tests {
+		a := ttdb.LoginAttempts{Failures: tt.failures}
+		if tt.failures > 0 {
+			a.Last = now.Add(-tt.ago)
+		}
+		if tt.locked > 0 {
+			a.LockedUntil = now.Add(tt.locked)
+		}
+		wait, locked := s.loginWait(a, now)
+		if wait != tt.want || locked != tt.isLocked {
+			t.Errorf("%s: loginWait = %v, %v, want %v, %v", tt.name, wait, locked, tt.want, tt.isLocked)
+		}
+	}
+
+	//a lockout that ended exactly now is over, whatever else is going on
+	if wait, locked := s.loginWait(ttdb.LoginAttempts{LockedUntil: now}, now); wait != 0 || locked {
+		t.Errorf("lockout ending now: loginWait = %v, %v, want 0, false", wait, locked)
+	}
+	//no base delay turns the slowing down off
+	off := &Server{LoginFreeAttempts: 3, LoginMaxDelay: 8 * time.Second}
+	if wait, _ := off.loginWait(ttdb.LoginAttempts{Failures: 10, Last: now}, now); wait != 0 {
+		t.Errorf("no base delay: loginWait = %v, want 0", wait)
+	}
+}
+
+//acceptedConn - the server's end of a connection dialled on l
+func acceptedConn(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+	client, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server
+}
+
+func TestRemoteAddress(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	p := proto.New(acceptedConn(t, tcp))
+	defer p.Close()
+	if got := remoteAddress(p); got != "127.0.0.1" {
+		t.Errorf("tcp: remoteAddress = %q, want the host without the port", got)
+	}
+
+	unix, err := net.Listen("unix", filepath.Join(t.TempDir(), "test.sock"))
+	if err != nil {
+		t.Skip("can't make a unix socket here:", err)
+	}
+	defer unix.Close()
+	//every local user would be the same address otherwise, and one could lock out the rest
+	want := "local"
+	if runtime.GOOS == "linux" {
+		want = "uid:" + strconv.Itoa(os.Getuid())
+	}
+	p = proto.New(acceptedConn(t, unix))
+	defer p.Close()
+	if got := remoteAddress(p); got != want {
+		t.Errorf("unix: remoteAddress = %q, want %q", got, want)
+	}
+}
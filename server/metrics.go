@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	proto "termtexter/proto"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	METRICS_NAMESPACE = "termtexter"
+	METRICS_PATH      = "/metrics"
+)
+
+//Request results, the result label on termtexter_requests_total
+const (
+	RESULT_OK            = "ok"
+	RESULT_REFUSED       = "refused" //a requestError, the client's fault
+	RESULT_ERROR         = "error"   //our fault
+	RESULT_PANIC         = "panic"
+	RESULT_RATE_LIMITED  = "rate-limited"
+	RESULT_SHUTTING_DOWN = "shutting-down"
+)
+
+//Why the server hung up on someone, the reason label on termtexter_dropped_connections_total
+const (
+	DROP_NO_HELLO      = "no-hello"
+	DROP_MISSED_PONGS  = "missed-pongs"
+	DROP_SLOW_CONSUMER = "slow-consumer"
+	DROP_WRITE_FAILED  = "write-failed"
+	DROP_FLOODING      = "flooding"
+	DROP_IDLE          = "idle" //quiet for too long, without heartbeats to tell us if they're still there
+)
+
+//metrics - what the admin listener serves on /metrics, in the Prometheus format. The gauges are read off the
+//server when they're scraped, everything else is counted as it happens
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec   //by packet type and result
+	latency  *prometheus.HistogramVec //by packet type
+	queries  *prometheus.HistogramVec //by db query
+	messages prometheus.Counter       //not by room, anyone can make rooms and every label value is a new series
+	dropped  *prometheus.CounterVec   //by reason
+}
+
+//newMetrics - registers every metric, the gauges reading from s
+func newMetrics(s *Server) *metrics {
+	m := &metrics{registry: prometheus.NewRegistry()}
+	m.requests = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: METRICS_NAMESPACE, Name: "requests_total",
+		Help: "Requests handled, by packet type and result."}, []string{"type", "result"})
+	m.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: METRICS_NAMESPACE, Name: "request_duration_seconds",
+		Help: "How long requests took to handle, by packet type.", Buckets: prometheus.DefBuckets}, []string{"type"})
+	m.queries = prometheus.NewHistogramVec(prometheus.HistogramOpts{Namespace: METRICS_NAMESPACE, Name: "db_query_duration_seconds",
+		Help: "How long database calls took, by query.", Buckets: prometheus.DefBuckets}, []string{"query"})
+	m.messages = prometheus.NewCounter(prometheus.CounterOpts{Namespace: METRICS_NAMESPACE, Name: "messages_posted_total",
+		Help: "Messages posted."})
+	m.dropped = prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: METRICS_NAMESPACE, Name: "dropped_connections_total",
+		Help: "Connections the server hung up on, by reason."}, []string{"reason"})
+
+	m.registry.MustRegister(m.requests, m.latency, m.queries, m.messages, m.dropped,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: METRICS_NAMESPACE, Name: "connected_clients",
+			Help: "Open connections, logged in or not."}, func() float64 {
+			return float64(s.live.count())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: METRICS_NAMESPACE, Name: "logged_in_users",
+			Help: "Users with at least one logged in connection."}, func() float64 {
+			return float64(s.conns.users())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: METRICS_NAMESPACE, Name: "fanout_queue_depth",
+			Help: "Packets queued for writing, across every connection."}, func() float64 {
+			depth := 0
+			for _, p := range s.live.all() {
+				depth += p.Queued()
+			}
+			return float64(depth)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: METRICS_NAMESPACE, Name: "fanout_deliveries_total",
+			Help: "Posted messages queued for a subscribed connection."}, func() float64 {
+			return float64(atomic.LoadInt64(&s.hub.stats.deliveries))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: METRICS_NAMESPACE, Name: "fanout_failed_total",
+			Help: "Posted messages that couldn't be queued for a subscribed connection."}, func() float64 {
+			return float64(atomic.LoadInt64(&s.hub.stats.failed))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: METRICS_NAMESPACE, Name: "fanout_posts_total",
+			Help: "Posted messages handed to the hub."}, func() float64 {
+			return float64(atomic.LoadInt64(&s.hub.stats.posts))
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{Namespace: METRICS_NAMESPACE, Name: "fanout_latency_seconds_total",
+			Help: "Time from reading a post to queueing it, summed over deliveries. Divide by fanout_deliveries_total for the average."},
+			func() float64 {
+				return time.Duration(atomic.LoadInt64(&s.hub.stats.latency)).Seconds()
+			}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{Namespace: METRICS_NAMESPACE, Name: "fanout_max_latency_seconds",
+			Help: "The longest any post took to be queued for a connection."}, func() float64 {
+			return time.Duration(atomic.LoadInt64(&s.hub.stats.maxLatency)).Seconds()
+		}),
+		wireCollector{s},
+	)
+	return m
+}
+
+//wireCollector - bytes in and out, across closed and open connections. raw is before compression and wire is what
+//actually crossed the network, so rate(raw) / rate(wire) is the compression ratio
+type wireCollector struct {
+	s *Server
+}
+
+var (
+	rawBytesDesc = prometheus.NewDesc(prometheus.BuildFQName(METRICS_NAMESPACE, "", "bytes_raw_total"),
+		"Packet bytes before compression, by direction.", []string{"direction"}, nil)
+	wireBytesDesc = prometheus.NewDesc(prometheus.BuildFQName(METRICS_NAMESPACE, "", "bytes_wire_total"),
+		"Bytes on the network after compression, by direction.", []string{"direction"}, nil)
+)
+
+func (wc wireCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rawBytesDesc
+	ch <- wireBytesDesc
+}
+
+func (wc wireCollector) Collect(ch chan<- prometheus.Metric) {
+	st := wc.s.wire.total(&wc.s.live)
+	ch <- prometheus.MustNewConstMetric(rawBytesDesc, prometheus.CounterValue, float64(st.RawIn), "in")
+	ch <- prometheus.MustNewConstMetric(rawBytesDesc, prometheus.CounterValue, float64(st.RawOut), "out")
+	ch <- prometheus.MustNewConstMetric(wireBytesDesc, prometheus.CounterValue, float64(st.WireIn), "in")
+	ch <- prometheus.MustNewConstMetric(wireBytesDesc, prometheus.CounterValue, float64(st.WireOut), "out")
+}
+
+//request - counts a handled request and how long it took
+func (m *metrics) request(typ string, result string, took time.Duration) {
+	m.requests.WithLabelValues(typ, result).Inc()
+	m.latency.WithLabelValues(typ).Observe(took.Seconds())
+}
+
+//refused - counts a request that never got to its handler, like one over the rate limit
+func (m *metrics) refused(typ string, result string) {
+	m.requests.WithLabelValues(typ, result).Inc()
+}
+
+//query - for termtexterdb.DB.Observe
+func (m *metrics) query(query string, took time.Duration) {
+	m.queries.WithLabelValues(query).Observe(took.Seconds())
+}
+
+func (m *metrics) posted() {
+	m.messages.Inc()
+}
+
+func (m *metrics) drop(reason string) {
+	m.dropped.WithLabelValues(reason).Inc()
+}
+
+//result - the result label for what a handler returned
+func result(err error) string {
+	var re *requestError
+	switch {
+	case err == nil:
+		return RESULT_OK
+	case errors.As(err, &re):
+		return RESULT_REFUSED
+	default:
+		return RESULT_ERROR
+	}
+}
+
+//adminServer - the HTTP server for operators, not clients: metrics and the health checks in health.go.
+//Keep it off the public network
+func (s *Server) adminServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc(HEALTHZ_PATH, s.healthz)
+	mux.HandleFunc(READYZ_PATH, s.readyz)
+	return &http.Server{Handler: mux}
+}
+
+//serveAdmin - runs s.admin on listener until Shutdown is done with it
+func (s *Server) serveAdmin(listener net.Listener) {
+	if err := s.admin.Serve(listener); err != http.ErrServerClosed {
+		slog.Error("Admin listener stopped", "err", err)
+	}
+}
+
+//countDrop - if the connection ended because its writer gave up on it, counts why
+func (s *Server) countDrop(p *proto.Proto) {
+	err := p.Err()
+	switch {
+	case errors.Is(err, proto.ErrSlowConsumer):
+		s.metrics.drop(DROP_SLOW_CONSUMER)
+	case err != nil && !errors.Is(err, proto.ErrClosed):
+		s.metrics.drop(DROP_WRITE_FAILED)
+	}
+}
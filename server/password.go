@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	ttdb "termtexter/db"
+	proto "termtexter/proto"
+)
+
+const (
+	PASSWORD_MAX_LENGTH = 72 //bcrypt ignores anything past this many bytes
+)
+
+//weakPassword - why the password isn't good enough for username, nil if it is
+func (s *Server) weakPassword(username string, password string) error {
+	weak := func(message string) error {
+		return badRequest(proto.ERR_WEAK_PASSWORD, message, proto.FIELD_PASSWORD)
+	}
+	if len([]rune(password)) < s.PasswordMinLength {
+		return weak(fmt.Sprintf("Passwords need at least %d characters", s.PasswordMinLength))
+	}
+	if len(password) > PASSWORD_MAX_LENGTH {
+		return weak(fmt.Sprintf("Passwords can't be longer than %d bytes", PASSWORD_MAX_LENGTH))
+	}
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return weak("Passwords can't have your username in them")
+	}
+	if characterClasses(password) < s.PasswordMinClasses {
+		return weak(fmt.Sprintf("Passwords need at least %d of lower case letters, upper case letters, digits and symbols", s.PasswordMinClasses))
+	}
+	return nil
+}
+
+//handleChangePassword - a logged in user picking a new password. They have to know the old one, so a session
+//left open somewhere can't be used to take the account, and every other session they have is logged out
+func (s *Server) handleChangePassword(cp proto.ChangePasswordRequest, p *proto.Proto) error {
+	id, intid, err := s.intUserFromKey(cp.Key)
+	if err != nil {
+		return err
+	}
+	if cp.OldPassword == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Current password cannot be empty", proto.FIELD_OLD_PASSWORD)
+	}
+	if cp.Password == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "New password cannot be empty", proto.FIELD_PASSWORD)
+	}
+
+	//guessing the old password here counts the same as guessing it at login
+	now := time.Now()
+	attempts, err := s.db.GetLoginAttempts(id)
+	if err != nil {
+		return err
+	}
+	if err := loginRefused(s.loginWait(attempts, now)); err != nil {
+		return err
+	}
+	valid, err := s.db.IsValidLogin(id, cp.OldPassword)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		s.log(p).Info("Bad password change, wrong current password")
+		if _, err := s.userFailed(id, now); err != nil {
+			return err
+		}
+		return forbidden(proto.ERR_BAD_LOGIN, "Current password is incorrect", proto.FIELD_OLD_PASSWORD)
+	}
+	if attempts != (ttdb.LoginAttempts{}) {
+		if err := s.db.SetLoginAttempts(id, ttdb.LoginAttempts{}); err != nil {
+			return err
+		}
+	}
+
+	username, err := s.db.GetUsername(id)
+	if err != nil {
+		return err
+	}
+	if err := s.weakPassword(username, cp.Password); err != nil {
+		return err
+	}
+	if err := s.db.ChangePassword(id, cp.Password, cp.Key); err != nil {
+		return err
+	}
+	//their sessions are gone from the database, hang up on anyone still using one
+	for _, q := range s.conns.get(intid) {
+		if q != p {
+			q.Close()
+		}
+	}
+	s.log(p).Info("Password changed, other sessions logged out")
+	return p.SendChangePasswordResponse(cp.RequestID)
+}
+
+//characterClasses - how many of lower case, upper case, digits and everything else the password has
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	proto "termtexter/proto"
+)
+
+func TestWeakPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		minClasses int
+		username   string
+		password   string
+		weak       bool
+	}{
+		{"one short of the minimum", 2, "", "abcdefgh1", true},
+		{"exactly the minimum", 2, "", "abcdefghi1", false},
+		{"minimum counted in characters, not bytes", 2, "", "ééééééééé1", false},
+		{"at the bcrypt limit", 2, "", strings.Repeat("aB", 36), false},
+		{"one byte over the bcrypt limit", 2, "", strings.Repeat("aB", 36) + "c", true},
+		{"over the bcrypt limit in bytes, not characters", 2, "", strings.Repeat("é", 36) + "1", true},
+		{"has the username", 2, "alice", "xxalicexx12", true},
+		{"has the username in another case", 2, "Alice", "xxALICExx12", true},
+		{"no username to check", 2, "", "xxalicexx12", false},
+		{"only lower case", 2, "", "abcdefghij", true},
+		{"lower case and digits", 2, "", "abcdefghi1", false},
+		{"three of four classes when four are needed", 4, "", "abcDEF1234", true},
+		{"all four classes", 4, "", "abcDEF123!", false},
+	}
+	for _, tt := range tests {
+		s := &Server{PasswordMinLength: 10, PasswordMinClasses: tt.minClasses}
+		err := s.weakPassword(tt.username, tt.password)
+		if !tt.weak {
+			if err != nil {
+				t.Errorf("%s: refused with %v", tt.name, err)
+			}
+			continue
+		}
+		var re *requestError
+		if !errors.As(err, &re) || re.Reason != proto.ERR_WEAK_PASSWORD || re.Field != proto.FIELD_PASSWORD {
+			t.Errorf("%s: got %v, want a weak password refusal", tt.name, err)
+		}
+	}
+}
+
+func TestCharacterClasses(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"ABC", 1},
+		{"123", 1},
+		{"!@#", 1},
+		{"aB", 2},
+		{"a1", 2},
+		{"a!", 2},
+		{"aB1", 3},
+		{"aB1!", 4},
+		{"aB1 ", 4}, //a space is a symbol
+		{"éÉ٣", 3},  //letters and digits outside ASCII count too
+	}
+	for _, tt := range tests {
+		if got := characterClasses(tt.password); got != tt.want {
+			t.Errorf("characterClasses(%q) = %d, want %d", tt.password, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+//peerUser - asks the kernel which Unix user is on the other end of a Unix socket. Empty if it isn't one or we can't tell
+func peerUser(conn net.Conn) string {
+	uid := peerUID(conn)
+	if uid == "" {
+		return ""
+	}
+	u, err := user.LookupId(uid)
+	if err != nil {
+		return ""
+	}
+	return u.Username
+}
+
+//peerUID - the uid of the Unix user on the other end of a Unix socket, even one without an account name.
+//Empty if it isn't one or we can't tell
+func peerUID(conn net.Conn) string {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return ""
+	}
+	return strconv.Itoa(int(cred.Uid))
+}
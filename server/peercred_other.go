@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+//peerUser - SO_PEERCRED is Linux only, everywhere else Unix socket clients log in like everyone else
+func peerUser(conn net.Conn) string {
+	return ""
+}
+
+//peerUID - Linux only too, so every Unix socket client looks like the same one
+func peerUID(conn net.Conn) string {
+	return ""
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	LIMITER_SWEEP = time.Minute //how often idle buckets are forgotten
+)
+
+//reserve - takes a token from lim if there is one. If not, wait is how long until there will be
+func reserve(lim *rate.Limiter) (ok bool, wait time.Duration) {
+	now := time.Now()
+	r := lim.ReserveN(now, 1)
+	if !r.OK() {
+		//a burst of 0, nothing gets through
+		return false, time.Second
+	}
+	if wait := r.DelayFrom(now); wait > 0 {
+		r.CancelAt(now)
+		return false, wait
+	}
+	return true, 0
+}
+
+//limiters - a token bucket for each user or room, made on first use. A bucket that has sat idle long enough
+//to fill back up is no different from a new one, so those get forgotten to keep the map small
+type limiters struct {
+	mu      sync.Mutex
+	limit   rate.Limit //0 for no limit
+	burst   int
+	buckets map[int]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	lim  *rate.Limiter
+	used time.Time
+}
+
+func newLimiters(limit rate.Limit, burst int) *limiters {
+	return &limiters{limit: limit, burst: burst, buckets: make(map[int]*bucket)}
+}
+
+//allow - takes a token from key's bucket, see reserve
+func (l *limiters) allow(key int) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.swept) > LIMITER_SWEEP {
+		l.sweep(now)
+	}
+	b := l.buckets[key]
+	if b == nil {
+		b = &bucket{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.used = now
+	return reserve(b.lim)
+}
+
+func (l *limiters) sweep(now time.Time) {
+	full := time.Duration(float64(l.burst) / float64(l.limit) * float64(time.Second))
+	for key, b := range l.buckets {
+		if now.Sub(b.used) > full {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
+
+//slowModes - channels a room admin has slowed down, by channel id. Only kept in memory: it's for riding out
+//a busy moment, not a setting, so a restart clearing it is fine
+type slowModes struct {
+	mu       sync.Mutex
+	channels map[int]*slowMode
+}
+
+type slowMode struct {
+	interval time.Duration
+	until    time.Time
+	last     map[int]time.Time //user id to when they last posted
+}
+
+//set - one message per interval for everyone in the channel until until. An interval of 0 turns it off
+func (sm *slowModes) set(channel int, interval time.Duration, until time.Time) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.channels == nil {
+		sm.channels = make(map[int]*slowMode)
+	}
+	if interval <= 0 {
+		delete(sm.channels, channel)
+		return
+	}
+	sm.channels[channel] = &slowMode{interval: interval, until: until, last: make(map[int]time.Time)}
+}
+
+//post - records a post by uid if slow mode lets them make it. If it doesn't, wait is how long they have left
+func (sm *slowModes) post(channel int, uid int) (ok bool, wait time.Duration) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	mode := sm.channels[channel]
+	if mode == nil {
+		return true, 0
+	}
+	now := time.Now()
+	if now.After(mode.until) {
+		delete(sm.channels, channel)
+		return true, 0
+	}
+	if wait := mode.last[uid].Add(mode.interval).Sub(now); wait > 0 {
+		return false, wait
+	}
+	mode.last[uid] = now
+	return true, 0
+}
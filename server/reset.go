@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	ttdb "termtexter/db"
+	proto "termtexter/proto"
+)
+
+const (
+	RESET_TOKEN_BYTES = 16
+)
+
+var errBadToken = forbidden(proto.ERR_BAD_TOKEN, "That reset token is wrong, used or expired", proto.FIELD_TOKEN)
+
+//newResetToken - a random token to hand to the user, and the hash of it to keep
+func newResetToken() (token string, hash string, err error) {
+	b := make([]byte, RESET_TOKEN_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(b)
+	return token, hashResetToken(token), nil
+}
+
+//hashResetToken - what the database knows a token by. The tokens are random, so there's nothing for a slow hash to protect
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(token))))
+	return hex.EncodeToString(sum[:])
+}
+
+//handleResetPassword - sets a new password with a token from the reset command. Anyone can try, so wrong tokens
+//count against their address the same as failed logins
+func (s *Server) handleResetPassword(rp proto.ResetPasswordRequest, p *proto.Proto) error {
+	if rp.Token == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Reset token cannot be empty", proto.FIELD_TOKEN)
+	}
+	if rp.Password == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Password cannot be empty", proto.FIELD_PASSWORD)
+	}
+	now := time.Now()
+	addr := remoteAddress(p)
+	if err := loginRefused(s.loginWait(s.addrAttempts.get(addr), now)); err != nil {
+		return err
+	}
+
+	hash := hashResetToken(rp.Token)
+	id, err := s.db.GetResetToken(hash)
+	if errors.Is(err, ttdb.ErrNotFound) {
+		s.log(p).Info("Bad password reset token")
+		s.addressFailed(addr, now)
+		return errBadToken
+	}
+	if err != nil {
+		return err
+	}
+	intid, err := strconv.Atoi(id)
+	if err != nil {
+		return err
+	}
+	username, err := s.db.GetUsername(id)
+	if err != nil {
+		return err
+	}
+	if err := s.weakPassword(username, rp.Password); err != nil {
+		return err
+	}
+	err = s.db.ResetPassword(id, hash, rp.Password)
+	if errors.Is(err, ttdb.ErrNotFound) {
+		//someone else used it first
+		return errBadToken
+	}
+	if err != nil {
+		return err
+	}
+	//whoever was logged in as them before, isn't now
+	for _, q := range s.conns.get(intid) {
+		q.Close()
+	}
+	s.log(p).Info("Password reset with a token", "username", username)
+	return p.SendResetPasswordResponse(rp.RequestID)
+}
@@ -1,69 +1,260 @@
 package main
 
 import (
-	"container/list"
+	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"net/http"
 	"os"
-	"reflect"
+	"os/signal"
+	"runtime/debug"
 	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	ttdb "termtexter/db"
 	proto "termtexter/proto"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/google/uuid"
+	"golang.org/x/time/rate"
 )
 
 const (
 	HTTP_OK          = 200
 	HTTP_FORBIDDEN   = 403
 	HTTP_BADREQUEST  = 400
+	HTTP_TOO_MANY    = 429
 	HTTP_ERROR       = 500
 	HTTP_UNAVAILABLE = 503
+	HELLO_TIMEOUT    = 10 * time.Second
 )
 
 //Server - an instance of a termtexter server
 type Server struct {
-	db          ttdb.DB
-	connections map[int]*list.List  //map of user ids to an array of sockets, because one user can be logged in multiple places at the same time
-	Rooms       map[int]*proto.Room //map of rooms to keep track of room information
+	db    ttdb.DB
+	conns registry  //map of user ids to their sockets, because one user can be logged in multiple places at the same time
+	rooms roomCache //every active room and its members
+	hub   hub       //which connections get the messages posted in each room
+	wire  wireStats //bytes in and out, before and after compression
+	live  liveConns //every open connection, logged in or not
+	//numbers each connection for the logs
+	nextConn uint64
+	metrics  *metrics //served on AdminAddr, see metrics.go
+	//flood protection, see ratelimit.go. The per connection limiter lives in handleClient
+	users     *limiters
+	roomPosts *limiters
+	slow      slowModes
+	//failed logins by address, see loginguard.go. The ones by username are in the database
+	addrAttempts addressAttempts
+	challenges   challenges   //logins waiting on a two-factor code
+	admin        *http.Server //metrics and health checks for operators
+	//shutting down, see shutdown.go. serving and closing are guarded by mu, handlers counts requests in flight and clients open connections
+	mu        sync.RWMutex
+	serving   bool //the listeners are up, for /readyz
+	closing   bool
+	handlers  sync.WaitGroup
+	clients   sync.WaitGroup
+	listeners []listener //everything Init opened, guarded by mu so Shutdown closes all of them
+	web       *http.Server
+	done      chan struct{}
+	//where to listen, empty to not bother. TLS is used on TCP and WebSocket if it's set
+	TCPAddr       string
+	WebSocketAddr string
+	UnixSocket    string
+	PeerCredLogin bool   //log Unix socket clients in as the termtexter user with their Unix username, no password needed
+	AdminAddr     string //host:port for /metrics, /healthz and /readyz, keep it off the public network
+	TLS           *tls.Config
+	DBBackend     string
+	DBDSN         string
+	HelloTimeout  time.Duration //how long a new connection has to say hello
+	//how often to ping a quiet connection, and how many unanswered pings before we drop it
+	PingInterval   time.Duration
+	MaxMissedPongs int
+	//packets a second each connection can keep up and how many it can send at once, 0 for no limit
+	RateLimit rate.Limit
+	RateBurst int
+	//the same across all of a user's connections once they're logged in
+	UserRateLimit rate.Limit
+	UserRateBurst int
+	//messages a second that can be posted to one room, by everyone in it
+	RoomRateLimit rate.Limit
+	RoomRateBurst int
+	//rate limited packets in a row before a connection is dropped for flooding, 0 to never drop them
+	MaxStrikes int
+	//the longest a room admin can turn slow mode on for
+	MaxSlowMode time.Duration
+	//failed login handling, see loginguard.go
+	LoginFreeAttempts           int
+	LoginBaseDelay              time.Duration
+	LoginMaxDelay               time.Duration
+	LoginLockoutAttempts        int //per username, 0 to never lock
+	LoginAddressLockoutAttempts int //per remote address, 0 to never lock
+	LoginLockout                time.Duration
+	//rules for new passwords, see password.go
+	PasswordMinLength  int
+	PasswordMinClasses int
+	//the name authenticator apps show for us, and whether room admins have to have two-factor on
+	TwoFactorIssuer string
+	TwoFactorAdmins bool
+	//how long Shutdown waits on requests and connections, and how long clients are told to wait before reconnecting
+	ShutdownTimeout time.Duration
+	RetryAfter      time.Duration
 }
 
-func (s Server) check(e error) {
-	if e != nil {
-		panic(e)
+// Init - Initalizes a termtexter server, listening on every address it's been given. Returns once Shutdown is done,
+// or straight away if it couldn't get started
+func (s *Server) Init() error {
+	s.metrics = newMetrics(s)
+	s.users = newLimiters(s.UserRateLimit, s.UserRateBurst)
+	s.roomPosts = newLimiters(s.RoomRateLimit, s.RoomRateBurst)
+	s.db.Observe = s.metrics.query
+	s.mu.Lock()
+	if s.WebSocketAddr != "" {
+		s.web = s.webSocketServer()
 	}
+	if s.AdminAddr != "" {
+		s.admin = s.adminServer()
+	}
+	s.mu.Unlock()
+	err := s.listenAll()
+	if errors.Is(err, errShuttingDown) {
+		//a signal beat us to it, there's nothing to serve
+		<-s.doneChan()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// connect to our db package
+	if err := s.db.Connect(s.DBBackend, s.DBDSN); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	for _, l := range s.listeners {
+		switch l.kind {
+		case LISTENER_WEBSOCKET:
+			go s.serveWebSocket(l)
+		case LISTENER_ADMIN:
+			go s.serveAdmin(l)
+		default:
+			go s.serve(l)
+		}
+	}
+	s.serving = true
+	s.mu.Unlock()
+	//everything is running in the background from here on
+	<-s.doneChan()
+	return nil
 }
 
-// Init - Initalizes a termtexter server
-func (s *Server) Init(port int) {
-	service := ":" + strconv.Itoa(port)
-	tcpAddr, err := net.ResolveTCPAddr("tcp4", service)
-	s.check(err)
-	listener, err := net.ListenTCP("tcp", tcpAddr)
-	s.check(err)
-	//init the maps we have
-	s.connections = make(map[int]*list.List)
-	s.Rooms = make(map[int]*proto.Room)
+//What a listener is for, so Init knows what to serve on it and Shutdown knows when to close it
+const (
+	LISTENER_CLIENT    = "client" //raw TCP, with or without TLS, or the Unix socket
+	LISTENER_WEBSOCKET = "websocket"
+	LISTENER_ADMIN     = "admin" //closed last, so health checks can see the shutdown
+)
 
-	// connect to our db package
-	s.db.Connect(os.Args[1], os.Args[2])
+//errShuttingDown - Shutdown started while Init was still opening listeners
+var errShuttingDown = errors.New("the server is shutting down")
+
+//listener - one of the sockets Init opened
+type listener struct {
+	net.Listener
+	kind string
+}
+
+//listenAll - opens every listener the config asks for
+func (s *Server) listenAll() error {
+	if s.TCPAddr != "" {
+		if err := s.listen("tcp", s.TCPAddr, LISTENER_CLIENT, s.TLS); err != nil {
+			return err
+		}
+	}
+	if s.UnixSocket != "" {
+		if err := clearSocket(s.UnixSocket); err != nil {
+			return err
+		}
+		if err := s.listen("unix", s.UnixSocket, LISTENER_CLIENT, nil); err != nil {
+			return err
+		}
+		//everyone on the host is allowed to connect, they still have to log in (or be known by PeerCredLogin)
+		if err := os.Chmod(s.UnixSocket, 0666); err != nil {
+			return err
+		}
+	}
+	if s.WebSocketAddr != "" {
+		//the WebSocket server does its own TLS
+		if err := s.listen("tcp", s.WebSocketAddr, LISTENER_WEBSOCKET, nil); err != nil {
+			return err
+		}
+	}
+	if s.AdminAddr != "" {
+		if err := s.listen("tcp", s.AdminAddr, LISTENER_ADMIN, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//clearSocket - removes the socket left by the last run, it'd stop us from listening. Anything else at the path is
+//left alone and is a config error, it's not ours to delete
+func clearSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("unix_socket: %s is already there and isn't a socket", path)
+	}
+	return os.Remove(path)
+}
 
+//listen - opens a listener and records it for Shutdown, both under mu. Once Shutdown has started it refuses,
+//so nothing opened after Shutdown looked at the list is left open
+func (s *Server) listen(network string, addr string, kind string, tlsConfig *tls.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return errShuttingDown
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	s.listeners = append(s.listeners, listener{l, kind})
+	return nil
+}
+
+//serve - hands every connection on this listener to handleClient
+func (s *Server) serve(listener net.Listener) {
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			//Shutdown closed it
+			return
+		}
 		if err != nil {
 			continue
 		}
-		log.Println("Someone connected.")
 		go s.handleClient(conn)
 	}
 }
 
-//DistributeMessage -
-func (s *Server) DistributeMessage(id int, pm proto.PostMessageRequest, rowid int64) {
+//DistributeMessage - sends a freshly posted message to every connection subscribed to its room. received is when we read the post
+func (s *Server) DistributeMessage(id int, pm proto.PostMessageRequest, rowid int64, received time.Time) {
 	dm := proto.DynamicMessage{}
 	dm.Channel = pm.Channel
 	dm.Timestamp = pm.Timestamp
@@ -75,344 +266,670 @@ func (s *Server) DistributeMessage(id int, pm proto.PostMessageRequest, rowid in
 	dm.Type = proto.DYNAMICMESSAGE
 	dm.Created = time.Now().Round(time.Second)
 
-	//loop through linked lists for every user in this room
-	for _, v := range s.Rooms[dm.Room].Users {
-		//go through the linked list, distributing the message to all who care
-		if s.connections[v.ID] != nil {
-			node := s.connections[v.ID].Front()
-			log.Println(s.connections[id].Len())
-			for i := 0; i < s.connections[id].Len(); i++ {
-				switch p := node.Value.(type) {
-				case *proto.Proto:
-					p.SendDynamicMessage(&dm)
-				default:
-					log.Fatalln("Did not get *proto.Proto in the linked list while distributing a message")
-				}
-				node = node.Next()
+	s.hub.publish(dm.Room, &dm, received)
+}
 
-			}
-		}
+//subscribeUser - subscribes every connection this user has to a room, like after they join or create it
+func (s *Server) subscribeUser(id int, rid int) {
+	for _, p := range s.conns.get(id) {
+		s.hub.subscribe(p, rid)
+	}
+}
+
+//unsubscribeUser - the opposite of subscribeUser, for when they leave a room
+func (s *Server) unsubscribeUser(id int, rid int) {
+	for _, p := range s.conns.get(id) {
+		s.hub.unsubscribe(p, rid)
 	}
 }
 
+//updateServerRooms - loads every room this user is in into the server's cache
 func (s *Server) updateServerRooms(id string) error {
 	res, err := s.db.GetRooms(id)
-	s.Rooms = res
+	for _, room := range res {
+		s.rooms.set(room)
+	}
 	return err
 }
 
-func (s *Server) handleLogin(l proto.Login, p proto.Proto) int {
+//updateServerRoom - reloads one room into the server's cache, like after someone joins or creates it
+func (s *Server) updateServerRoom(rid int) error {
+	room, err := s.db.GetRoom(rid)
+	if err != nil {
+		return err
+	}
+	s.rooms.set(room)
+	return nil
+}
+
+//addConnection - add this proto object to the sockets we know about for this user
+func (s *Server) addConnection(id int, p *proto.Proto) {
+	if s.conns.add(id, p) {
+		//this is their first connection, let everyone know they're here
+		s.broadcastPresence(id, true)
+	}
+}
+
+//removeConnection - drop this connection from the user's sockets, announcing them offline if it was their last one
+func (s *Server) removeConnection(id int, p *proto.Proto) {
+	found, last := s.conns.remove(id, p)
+	if !found {
+		s.log(p).Warn("Weird...we didn't find that connection in the registry", "user", id)
+		return
+	}
+	if last {
+		s.broadcastPresence(id, false)
+	}
+}
+
+//broadcastPresence - tell every connection that shares a room with this user that they came or went
+func (s *Server) broadcastPresence(id int, online bool) {
+	for _, uid := range s.rooms.peers(id) {
+		for _, p := range s.conns.get(uid) {
+			if p.Has(proto.FEATURE_PRESENCE) {
+				p.SendPresence(id, online)
+			}
+		}
+	}
+}
+
+//userFromKey - figures out which user is behind a session key, with an error for the client if there isn't one
+func (s *Server) userFromKey(key string) (string, error) {
+	if key == "" {
+		return "", forbidden(proto.ERR_EMPTY_FIELD, "You are not logged in", proto.FIELD_KEY)
+	}
+	id, err := s.db.GetUserIDFromKey(key)
+	if errors.Is(err, ttdb.ErrNotFound) {
+		//They're not a person in the database, or their session ran out
+		return "", forbidden(proto.ERR_BAD_KEY, "Your session has expired, please log in again", proto.FIELD_KEY)
+	}
+	return id, err
+}
+
+//intUserFromKey - userFromKey for the places that need the id as a number
+func (s *Server) intUserFromKey(key string) (string, int, error) {
+	id, err := s.userFromKey(key)
+	if err != nil {
+		return "", -1, err
+	}
+	intid, err := strconv.Atoi(id)
+	return id, intid, err
+}
+
+//handleLogin - checks their username and password (or Unix user), and hands them a session key. Returns their id
+func (s *Server) handleLogin(l proto.Login, p *proto.Proto, peer string) (int, error) {
+	//on a Unix socket the kernel can vouch for who they are, if they want that instead of a password
+	trusted := false
+	if peer != "" && p.Has(proto.FEATURE_PEERCRED) && l.Password == "" && (l.Username == "" || l.Username == peer) {
+		l.Username = peer
+		trusted = true
+	}
 	if l.Username == "" {
-		log.Println("Username cannot be an empty field.")
-		p.SendBadLoginResponse()
-		return -1
+		return -1, badRequest(proto.ERR_EMPTY_FIELD, "Username cannot be empty", proto.FIELD_USERNAME)
 	}
-	if l.Password == "" {
-		log.Println("Password cannot be an empty field.")
-		p.SendBadLoginResponse()
-		return -1
+	if l.Password == "" && !trusted {
+		return -1, badRequest(proto.ERR_EMPTY_FIELD, "Password cannot be empty", proto.FIELD_PASSWORD)
+	}
+
+	//someone guessing passwords has to wait longer after every miss, whichever account they go after
+	now := time.Now()
+	addr := remoteAddress(p)
+	if err := loginRefused(s.loginWait(s.addrAttempts.get(addr), now)); err != nil && !trusted {
+		//the kernel vouching for them isn't a guess, let it through
+		return -1, err
 	}
 
 	// We have a login packet, it has a username and password, let's check it against the database
 	id, err := s.db.GetUserID(l.Username)
-	var intid int
+	if errors.Is(err, ttdb.ErrNotFound) {
+		s.log(p).Info("Bad login, no such user", "username", l.Username)
+		s.addressFailed(addr, now)
+		return -1, errBadLogin
+	}
 	if err != nil {
-		intid = -1
-		log.Println("Bad login")
-		// They don't exist, craft a response that doesn't have a good login
-		err := p.SendBadLoginResponse()
-		s.check(err)
-	} else {
-		intid, err = strconv.Atoi(id)
-		s.check(err)
-		if id != "" {
-			res := s.db.IsValidLogin(id, l.Password)
-			if res {
-				//They are a real user. Give them a unique id for their successful login. This key lets them send messages from their account on the machine they logged in from
-				uuid, err := uuid.NewRandom()
-				s.check(err)
-				// Add this key to the DB, so we can check with this for each message
-				err = s.db.AddSession(id, uuid.String())
-				s.check(err)
-				// Send the packet with the updates
-				err = p.SendLoginResponse(uuid.String())
-				//add this proto object to our linked list of sockets for this user
-				//see if it has been initalized yet
-				if s.connections[intid] == nil {
-					s.connections[intid] = list.New()
-				}
-				s.connections[intid].PushBack(&p)
-				log.Println("Added the user to the linked list")
-				//See what rooms this user is in (for the server's records)
-				s.updateServerRooms(id)
-			} else {
-				// They don't exist, craft a response that doesn't have a good login
-				err := p.SendBadLoginResponse()
-				s.check(err)
+		return -1, err
+	}
+	intid, err := strconv.Atoi(id)
+	if err != nil {
+		return -1, err
+	}
+	if !trusted {
+		//and the same for each account, whoever is going after it
+		attempts, err := s.db.GetLoginAttempts(id)
+		if err != nil {
+			return -1, err
+		}
+		if err := loginRefused(s.loginWait(attempts, now)); err != nil {
+			return -1, err
+		}
+		valid, err := s.db.IsValidLogin(id, l.Password)
+		if err != nil {
+			return -1, err
+		}
+		if !valid {
+			s.log(p).Info("Bad login, wrong password", "username", l.Username)
+			s.addressFailed(addr, now)
+			attempts, err := s.userFailed(id, now)
+			if err != nil {
+				return -1, err
+			}
+			if attempts.LockedUntil.After(now) {
+				s.log(p).Warn("Locked out after too many failed logins", "username", l.Username, "until", attempts.LockedUntil)
 			}
-		} else {
-			// They don't exist, craft a response that doesn't have a good login
-			err := p.SendBadLoginResponse()
-			s.check(err)
+			return -1, errBadLogin
 		}
+		if attempts != (ttdb.LoginAttempts{}) {
+			if err := s.db.SetLoginAttempts(id, ttdb.LoginAttempts{}); err != nil {
+				return -1, err
+			}
+		}
+		s.addrAttempts.clear(addr)
+	}
+
+	//they are who they say, by password or by the kernel, but they want a code from their phone too before they're in
+	_, twoFactor, err := s.db.GetTwoFactor(id)
+	if err != nil {
+		return -1, err
+	}
+	if twoFactor {
+		token, err := s.challenges.add(p, id)
+		if err != nil {
+			return -1, err
+		}
+		return -1, p.SendTwoFactorChallenge(l.RequestID, token)
+	}
+	return intid, s.startSession(p, id, intid, l.RequestID)
+}
+
+//startSession - logs a connection in as a user who proved who they are, and tells them their session key
+func (s *Server) startSession(p *proto.Proto, id string, intid int, rid int) error {
+	//They are a real user. Give them a unique id for their successful login. This key lets them send messages from their account on the machine they logged in from
+	key, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	// Add this key to the DB, so we can check with this for each message
+	if err := s.db.AddSession(id, key.String()); err != nil {
+		return err
+	}
+	//See what rooms this user is in (for the server's records)
+	if err := s.updateServerRooms(id); err != nil {
+		return err
+	}
+	s.addConnection(intid, p)
+	s.hub.add(p, s.rooms.roomsOf(intid)...)
+	// Send the packet with the updates
+	return p.SendLoginResponse(rid, key.String())
+}
+
+//handleHello - the first packet on every connection. Agrees on a protocol version and the features both ends support.
+//peer is the Unix user on the other end, if we know it
+func (s *Server) handleHello(p *proto.Proto, peer string) bool {
+	msg, err := p.Decode()
+	h, ok := msg.(proto.Hello)
+	if !ok {
+		if err == nil || proto.Recoverable(err) {
+			s.log(p).Info("Client didn't start with a hello, dropping them")
+			p.SendError(0, HTTP_BADREQUEST, proto.ERR_NO_HELLO, "This server needs a newer client, please upgrade", "")
+		}
+		return false
+	}
+	version := proto.NegotiateVersion(h.MinVersion, h.Version)
+	if version == -1 {
+		s.log(p).Info("Client speaks protocol versions we don't, dropping them", "min_version", h.MinVersion, "version", h.Version)
+		p.SendError(h.RequestID, HTTP_BADREQUEST, proto.ERR_VERSION, fmt.Sprintf("This server speaks protocol versions %d to %d but your client speaks %d to %d, please upgrade",
+			proto.MIN_VERSION, proto.VERSION, h.MinVersion, h.Version), proto.FIELD_VERSION)
+		return false
+	}
+	features := proto.CommonFeatures(h.Features)
+	if peer == "" {
+		//only offer logging in by Unix user to people we know the Unix user of
+		features = without(features, proto.FEATURE_PEERCRED)
+	}
+	p.SetFeatures(features)
+	//the response still goes out as JSON, everything after it uses the new codec
+	codec := proto.NegotiateCodec(h.Codecs)
+	compression := proto.NegotiateCompression(h.Compressions)
+	p.SendHelloResponse(h.RequestID, version, features, codec, compression)
+	p.SetCodec(codec)
+	p.SetCompression(compression)
+	return true
+}
+
+//without - features minus the one we don't want
+func without(features []string, feature string) []string {
+	kept := make([]string, 0, len(features))
+	for _, f := range features {
+		if f != feature {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+//handleResume - a client reconnected and wants its old session key tied to the new connection. Returns their id
+func (s *Server) handleResume(r proto.ResumeRequest, p *proto.Proto) (int, error) {
+	if !p.Has(proto.FEATURE_RESUME) {
+		return -1, badRequest(proto.ERR_NO_FEATURE, "Resuming sessions was not agreed on in the hello", "")
+	}
+	// Figure out what user is behind this key, if nobody they'll have to login again
+	id, intid, err := s.intUserFromKey(r.Key)
+	if err != nil {
+		return -1, err
+	}
+	//See what rooms this user is in (for the server's records)
+	if err := s.updateServerRooms(id); err != nil {
+		return -1, err
 	}
-	return intid
+	s.addConnection(intid, p)
+	s.hub.add(p, s.rooms.roomsOf(intid)...)
+	return intid, p.SendResumeResponse(r.RequestID, HTTP_OK)
 }
 
-func (s *Server) handleMessage(m proto.Message, p proto.Proto) {
-	log.Println(m.Type)
-	log.Println(m.Timestamp)
-	log.Println(m.Message)
-	log.Println(m.Key)
+func (s *Server) handleMessage(m proto.Message, p *proto.Proto) error {
+	//the body only at debug, and never the key
+	s.log(p).Debug("Got a message", "timestamp", m.Timestamp, "message", m.Message)
+	return nil
 }
 
-func (s *Server) handleRegistration(r proto.Register, p proto.Proto) {
+func (s *Server) handleRegistration(r proto.Register, p *proto.Proto) error {
+	if r.Username == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Username cannot be empty", proto.FIELD_USERNAME)
+	}
+	if r.Password == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Password cannot be empty", proto.FIELD_PASSWORD)
+	}
+	if err := s.weakPassword(r.Username, r.Password); err != nil {
+		return err
+	}
 	//Make sure this username doesn't already exist
 	exists, err := s.db.UserExists(r.Username)
-	s.check(err)
+	if err != nil {
+		return err
+	}
 	if exists {
-		log.Println("Sorry, someone with this username already exists")
-		p.SendRegistrationResponse(HTTP_BADREQUEST)
-	} else {
-		//This username is not used, continue with the registration
-		err := s.db.Register(r.Username, r.Password)
-		s.check(err)
-		//Let them know how the registeration went
-		p.SendRegistrationResponse(HTTP_OK)
+		return badRequest(proto.ERR_EXISTS, "Someone already has that username", proto.FIELD_USERNAME)
+	}
+	//This username is not used, continue with the registration
+	if err := s.db.Register(r.Username, r.Password); err != nil {
+		return err
 	}
+	//Let them know how the registeration went
+	return p.SendRegistrationResponse(r.RequestID, HTTP_OK)
 }
-func (s *Server) handleCreateRoom(cr proto.CreateRoomRequest, p proto.Proto) {
+
+func (s *Server) handleCreateRoom(cr proto.CreateRoomRequest, p *proto.Proto) error {
 	if cr.Room == "" {
-		log.Println("Room name cannot be empty")
-		p.SendCreateRoomResponse(cr.Room, HTTP_ERROR)
-		return
-	}
-	if cr.Key == "" {
-		log.Println("Key cannot be empty")
-		p.SendCreateRoomResponse(cr.Room, HTTP_ERROR)
-		return
+		return badRequest(proto.ERR_EMPTY_FIELD, "Room name cannot be empty", proto.FIELD_ROOM)
 	}
 
 	//cr.Password can be left empty, if they don't want a password on their server
 
 	// Figure out what user is behind this key:
-	id, err := s.db.GetUserIDFromKey(cr.Key)
-	s.check(err)
-	if id == "" {
-		//They're not a person in the database
-		p.SendCreateRoomResponse(cr.Room, HTTP_FORBIDDEN)
-		return
+	id, intid, err := s.intUserFromKey(cr.Key)
+	if err != nil {
+		return err
+	}
+	//whoever makes a room is its admin
+	if err := s.requireTwoFactor(id); err != nil {
+		return err
 	}
 
 	//See if the room exists
 	res, err := s.db.DoesRoomExist(cr.Room)
-	s.check(err)
-
+	if err != nil {
+		return err
+	}
 	if res != -1 {
 		//The room exists...give them an error
-		p.SendCreateRoomResponse(cr.Room, HTTP_BADREQUEST)
-	} else {
-		//We can make the room, put the requester as an admin, and create a default channel
-		err := s.db.CreateRoom(cr.Room, id, cr.Password)
-		s.check(err)
-		//update the server cache
-		err = s.updateServerRooms(id)
-		s.check(err)
-		//We did it all, tell them how it went
-		p.SendCreateRoomResponse(cr.Room, HTTP_OK)
+		return badRequest(proto.ERR_EXISTS, "A room with that name already exists", proto.FIELD_ROOM)
+	}
+	//We can make the room, put the requester as an admin, and create a default channel
+	rid, err := s.db.CreateRoom(cr.Room, id, cr.Password)
+	if err != nil {
+		return err
+	}
+	//update the server cache
+	if err := s.updateServerRoom(rid); err != nil {
+		return err
 	}
+	s.subscribeUser(intid, rid)
+	//We did it all, tell them how it went
+	return p.SendCreateRoomResponse(cr.RequestID, cr.Room, HTTP_OK)
 }
 
-func (s *Server) handleJoinRoom(jr proto.JoinRoomRequest, p proto.Proto) {
+func (s *Server) handleJoinRoom(jr proto.JoinRoomRequest, p *proto.Proto) error {
 	if jr.Room == "" {
-		log.Println("Room name cannot be empty")
-		return
-	}
-	if jr.Key == "" {
-		log.Println("Key cannot be empty")
-		return
+		return badRequest(proto.ERR_EMPTY_FIELD, "Room name cannot be empty", proto.FIELD_ROOM)
 	}
 
 	// Figure out what user is behind this key:
-	id, err := s.db.GetUserIDFromKey(jr.Key)
-	s.check(err)
-	if id == "" {
-		//They're not a person in the database
-		p.SendJoinRoomResponse(jr.Room, HTTP_FORBIDDEN, -1)
-		return
+	id, intid, err := s.intUserFromKey(jr.Key)
+	if err != nil {
+		return err
 	}
 
 	//See if the room exists
 	res, err := s.db.DoesRoomExist(jr.Room)
-	s.check(err)
-	if res != -1 {
-		//This room does exist...
-		err = s.db.AddUserToRoom(id, res)
-		s.check(err)
-		if err == nil {
-			err = s.updateServerRooms(id)
-			if err == nil {
-				p.SendJoinRoomResponse(jr.Room, HTTP_OK, res)
-			} else {
-				//Something went wrong updating the server cache
-				p.SendJoinRoomResponse(jr.Room, HTTP_ERROR, -1)
-			}
-		}
-	} else {
+	if err != nil {
+		return err
+	}
+	if res == -1 {
 		//The room does not exist...send them a sad response
-		p.SendJoinRoomResponse(jr.Room, HTTP_BADREQUEST, -1)
+		return badRequest(proto.ERR_NOT_FOUND, "There is no room with that name", proto.FIELD_ROOM)
 	}
-
+	//This room does exist...
+	if err := s.db.AddUserToRoom(id, res); err != nil {
+		return err
+	}
+	if err := s.updateServerRoom(res); err != nil {
+		return err
+	}
+	s.subscribeUser(intid, res)
+	return p.SendJoinRoomResponse(jr.RequestID, jr.Room, HTTP_OK, res)
 }
 
-func (s *Server) handlePostMessage(pm proto.PostMessageRequest, p proto.Proto) {
-	if pm.Key == "" {
-		log.Println("Key cannot be empty")
-		p.SendPostMessageResponse(HTTP_FORBIDDEN)
-		return
+func (s *Server) handleLeaveRoom(lr proto.LeaveRoomRequest, p *proto.Proto) error {
+	if lr.Room == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Room name cannot be empty", proto.FIELD_ROOM)
 	}
 
 	// Figure out what user is behind this key:
-	id, err := s.db.GetUserIDFromKey(pm.Key)
-	s.check(err)
-	if id == "" {
-		//They're not a person in the database
-		p.SendPostMessageResponse(HTTP_FORBIDDEN)
-		return
+	id, intid, err := s.intUserFromKey(lr.Key)
+	if err != nil {
+		return err
+	}
+
+	//See if the room exists
+	res, err := s.db.DoesRoomExist(lr.Room)
+	if err != nil {
+		return err
+	}
+	if res == -1 {
+		return badRequest(proto.ERR_NOT_FOUND, "There is no room with that name", proto.FIELD_ROOM)
+	}
+	if err := s.db.RemoveUserFromRoom(id, res); err != nil {
+		return err
+	}
+	//update the server cache
+	s.rooms.leave(res, intid)
+	s.unsubscribeUser(intid, res)
+	return p.SendLeaveRoomResponse(lr.RequestID, lr.Room, HTTP_OK)
+}
+
+func (s *Server) handlePostMessage(pm proto.PostMessageRequest, p *proto.Proto) error {
+	received := time.Now()
+	// Figure out what user is behind this key:
+	id, intid, err := s.intUserFromKey(pm.Key)
+	if err != nil {
+		return err
+	}
+	if pm.Message == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Message cannot be empty", proto.FIELD_MESSAGE)
+	}
+	//everything from here on goes by the room, but the database only looks at the channel, so they have to agree
+	if err := s.checkPost(pm.Room, pm.Channel, intid); err != nil {
+		return err
+	}
+	if ok, wait := s.roomPosts.allow(pm.Room); !ok {
+		return rateLimited("This room is busy, try again in a moment", wait)
+	}
+	if ok, wait := s.slow.post(pm.Channel, intid); !ok {
+		return rateLimited(fmt.Sprintf("Slow mode is on, you can post again in %v", wait.Round(time.Second)), wait)
 	}
 
 	//try to insert the message in the proper place
 	rowID, err := s.db.PostMessage(id, pm)
-	s.check(err)
+	if err != nil {
+		return err
+	}
+	s.metrics.posted()
 	//distribute the message to all the proper connections
-	intid, err := strconv.Atoi(id)
-	s.check(err)
-	s.DistributeMessage(intid, pm, rowID)
+	s.DistributeMessage(intid, pm, rowID, received)
 	//send a good response to the sender
-	p.SendPostMessageResponse(HTTP_OK)
+	return p.SendPostMessageResponse(pm.RequestID, HTTP_OK)
+}
 
+//checkPost - refuses a post unless the channel is in the room and the poster is in it too
+func (s *Server) checkPost(room int, channel int, uid int) error {
+	if !s.rooms.hasChannel(room, channel) {
+		return badRequest(proto.ERR_NOT_FOUND, "There is no channel like that in the room", proto.FIELD_CHANNEL)
+	}
+	if !s.rooms.isMember(room, uid) {
+		return forbidden(proto.ERR_NOT_MEMBER, "You aren't in that room", proto.FIELD_ROOM)
+	}
+	return nil
 }
 
-func (s *Server) handleGetMessages(gm proto.GetMessagesRequest, p proto.Proto) {
-	if gm.Key == "" {
-		log.Println("Key cannot be empty")
-		p.SendGetMessagesResponse(HTTP_FORBIDDEN, nil)
-		return
+//handleSlowMode - a room admin slowing a channel down for a while, or letting it go again
+func (s *Server) handleSlowMode(sm proto.SlowModeRequest, p *proto.Proto) error {
+	// Figure out what user is behind this key:
+	id, err := s.userFromKey(sm.Key)
+	if err != nil {
+		return err
+	}
+	interval := time.Duration(sm.Interval) * time.Second
+	duration := time.Duration(sm.Duration) * time.Second
+	if interval < 0 {
+		return badRequest(proto.ERR_MISMATCH, "The interval can't be negative", proto.FIELD_INTERVAL)
+	}
+	if interval > 0 && duration <= 0 {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Slow mode needs to know how long to last", proto.FIELD_DURATION)
+	}
+	if duration > s.MaxSlowMode {
+		return badRequest(proto.ERR_MISMATCH, fmt.Sprintf("Slow mode can last %v at most", s.MaxSlowMode), proto.FIELD_DURATION)
+	}
+	if !s.rooms.hasChannel(sm.Room, sm.Channel) {
+		return badRequest(proto.ERR_NOT_FOUND, "There is no channel like that in the room", proto.FIELD_CHANNEL)
+	}
+	admin, err := s.db.IsRoomAdmin(id, sm.Room)
+	if err != nil {
+		return err
+	}
+	if !admin {
+		return forbidden(proto.ERR_NOT_ADMIN, "Only room admins can change slow mode", "")
 	}
+	if err := s.requireTwoFactor(id); err != nil {
+		return err
+	}
+
+	var until time.Time
+	if interval > 0 {
+		until = time.Now().Add(duration)
+	}
+	s.slow.set(sm.Channel, interval, until)
+	s.log(p).Info("Slow mode set", "room", sm.Room, "channel", sm.Channel, "interval", interval, "duration", duration)
+	return p.SendSlowModeResponse(sm.RequestID, sm.Room, sm.Channel, interval, until)
+}
 
+func (s *Server) handleGetMessages(gm proto.GetMessagesRequest, p *proto.Proto) error {
 	// Figure out what user is behind this key:
-	id, err := s.db.GetUserIDFromKey(gm.Key)
-	s.check(err)
-	if id == "" {
-		//They're not a person in the database
-		p.SendGetMessagesResponse(HTTP_FORBIDDEN, nil)
-		return
+	if _, err := s.userFromKey(gm.Key); err != nil {
+		return err
 	}
 
 	//See what messages this room has
-	res, err := s.db.GetMessages(gm.Room, gm.Channel)
-	s.check(err)
+	res, err := s.db.GetMessages(gm.Room, gm.Channel, gm.Since)
+	if err != nil {
+		return err
+	}
 
 	//Send them the list back
-	p.SendGetMessagesResponse(HTTP_OK, res)
-
+	return p.SendGetMessagesResponse(gm.RequestID, HTTP_OK, res)
 }
 
-func (s *Server) handleGetRooms(gr proto.GetRoomsRequest, p proto.Proto) {
-	if gr.Key == "" {
-		log.Println("Key cannot be empty")
-		p.SendGetRoomsResponse(HTTP_FORBIDDEN, nil)
-		return
-	}
-
+func (s *Server) handleGetRooms(gr proto.GetRoomsRequest, p *proto.Proto) error {
 	// Figure out what user is behind this key:
-	id, err := s.db.GetUserIDFromKey(gr.Key)
-	s.check(err)
-	if id == "" {
-		//They're not a person in the database
-		log.Println("Bad get rooms 1")
-		p.SendGetRoomsResponse(HTTP_FORBIDDEN, nil)
-		return
+	id, err := s.userFromKey(gr.Key)
+	if err != nil {
+		return err
 	}
 
 	//See what rooms this user is in
 	res, err := s.db.GetRooms(id)
-	s.check(err)
+	if err != nil {
+		return err
+	}
 
 	//Send them the list back
-	log.Println("Good get rooms 1")
-	spew.Dump(res)
-	p.SendGetRoomsResponse(HTTP_OK, res)
+	s.log(p).Debug("Sending rooms", "rooms", len(res))
+	return p.SendGetRoomsResponse(gr.RequestID, HTTP_OK, res)
+}
 
+//allow - whether a packet gets past the connection's limiter and, once they're logged in, the user's.
+//If not, wait is how long until it would
+func (s *Server) allow(limiter *rate.Limiter, id int) (ok bool, wait time.Duration) {
+	if limiter != nil {
+		if ok, wait := reserve(limiter); !ok {
+			return false, wait
+		}
+	}
+	if id != -1 {
+		return s.users.allow(id)
+	}
+	return true, 0
 }
 
 func (s *Server) handleClient(conn net.Conn) {
-	//defer conn.Close() // close connection before exit
-
+	//whatever goes wrong with one connection, the rest of the server keeps going
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("Panic on a connection", "remote", conn.RemoteAddr().String(), "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
 	//get a proto object which handles the message/protocol for us
-	p := proto.Proto{Conn: conn}
+	p := proto.New(conn)
+	defer p.Close()
+	lg := slog.With("conn", atomic.AddUint64(&s.nextConn, 1), "remote", conn.RemoteAddr().String())
+	if !s.track(p, lg) {
+		//too late, we're shutting down
+		return
+	}
+	defer s.untrack(p)
+	lg.Info("Connected", "network", conn.LocalAddr().Network())
 	id := -1 //the id of the client, if we get that far
-	flag := false
-	for !flag {
-		//based on the message type, take different actions
-		switch msg := p.Decode().(type) {
-		case proto.Login:
-			id = s.handleLogin(msg, p)
-		case proto.Message:
-			s.handleMessage(msg, p)
-		case proto.Register:
-			s.handleRegistration(msg, p)
-		case proto.JoinRoomRequest:
-			s.handleJoinRoom(msg, p)
-		case proto.CreateRoomRequest:
-			s.handleCreateRoom(msg, p)
-		case proto.GetRoomsRequest:
-			s.handleGetRooms(msg, p)
-		case proto.GetMessagesRequest:
-			s.handleGetMessages(msg, p)
-		case proto.PostMessageRequest:
-			s.handlePostMessage(msg, p)
-		default:
-			if msg == nil {
-				log.Println("Somebody left")
-				//drop this connection from our records, if it's not empty
-				if id != -1 {
-					found := false
-					node := s.connections[id].Front()
-					for node != nil && !found {
-						//for this id, see if one of these connection memory addresses match
-						switch p := node.Value.(type) {
-						case *proto.Proto:
-							if conn == p.Conn {
-								//if so, drop the node we are on from the linked list
-								s.connections[id].Remove(node)
-								//stop the loop, we found and removed the connection
-								found = true
-								log.Println("We dropped the connection from the linked list for the user who just left")
-							}
-						default:
-							log.Fatalln("Did not get *proto.Proto in the linked list")
-						}
-						node = node.Next()
-
-					}
-					if !found {
-						log.Println("Weird...we didn't find that connection in the linked list...")
-					}
-				}
-				flag = true
-				break
+	defer func() {
+		//drop this connection from our records, if it's not empty
+		if id != -1 {
+			s.removeConnection(id, p)
+		}
+		s.hub.drop(p)
+	}()
+	peer := ""
+	if s.PeerCredLogin {
+		peer = peerUser(conn)
+	}
+	//the first thing a client has to do is say hello, so we know we can understand each other
+	conn.SetReadDeadline(time.Now().Add(s.HelloTimeout))
+	if !s.handleHello(p, peer) {
+		s.metrics.drop(DROP_NO_HELLO)
+		return
+	}
+	//every connection is dropped once it goes quiet for too long, so half-open sockets don't stick around forever.
+	//The ones that can answer pings get them when they go quiet, so they only go that long if they're gone
+	hb := &heartbeat{}
+	hb.seen()
+	done := make(chan struct{})
+	defer close(done)
+	if p.Has(proto.FEATURE_HEARTBEAT) {
+		go s.keepAlive(p, hb, done)
+	}
+	var limiter *rate.Limiter
+	if s.RateLimit > 0 {
+		limiter = rate.NewLimiter(s.RateLimit, s.RateBurst)
+	}
+	strikes := 0 //rate limited packets in a row
+	for {
+		conn.SetReadDeadline(time.Now().Add(s.idleTimeout()))
+		msg, err := p.Decode()
+		hb.seen()
+		if err != nil && proto.Recoverable(err) {
+			//they sent us something we couldn't make sense of, tell them and carry on
+			s.log(p).Debug("Bad packet", "err", err)
+			reason := proto.ERR_MALFORMED
+			if errors.Is(err, proto.ErrUnknownType) {
+				reason = proto.ERR_UNKNOWN_TYPE
+			}
+			p.SendError(0, HTTP_BADREQUEST, reason, err.Error(), "")
+			continue
+		}
+		if err != nil && timedOut(err) {
+			s.log(p).Info("Connection went quiet, dropping it", "idle", s.idleTimeout())
+			if p.Has(proto.FEATURE_HEARTBEAT) {
+				s.metrics.drop(DROP_MISSED_PONGS)
 			} else {
-				r := reflect.TypeOf(msg)
-				fmt.Printf("Other:%v\n", r)
+				s.metrics.drop(DROP_IDLE)
 			}
+			return
 		}
-
+		if err != nil {
+			s.log(p).Info("Disconnected", "err", err)
+			s.countDrop(p)
+			return
+		}
+		if ok, wait := s.allow(limiter, id); !ok {
+			s.metrics.refused(proto.TypeOf(msg), RESULT_RATE_LIMITED)
+			p.SendRateLimited(proto.RequestIDOf(msg), "You're sending too fast, slow down", wait)
+			strikes++
+			if s.MaxStrikes > 0 && strikes >= s.MaxStrikes {
+				//they're not slowing down, no point listening any more
+				s.log(p).Warn("Dropping connection for flooding", "strikes", strikes)
+				s.metrics.drop(DROP_FLOODING)
+				return
+			}
+			continue
+		}
+		strikes = 0
+		if msg == nil {
+			s.log(p).Info("Disconnected")
+			return
+		}
+		//every begin that succeeds has to be matched by end, or Shutdown waits on it forever
+		if !s.begin() {
+			//we're shutting down and already told them, anything new waits for the next server
+			s.metrics.refused(proto.TypeOf(msg), RESULT_SHUTTING_DOWN)
+			p.SendError(proto.RequestIDOf(msg), HTTP_UNAVAILABLE, proto.ERR_SHUTDOWN, "The server is restarting, try again in a moment", "")
+			continue
+		}
+		s.dispatch(msg, p, peer, &id)
+		s.end()
 	}
-
 }
 
 func main() {
+	cfg, args, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Bad configuration:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(args) > 0 {
+		//an admin command rather than running the server
+		os.Exit(runCommand(cfg, args))
+	}
 	s := new(Server)
-	s.Init(1200)
+	if err := s.configure(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "Bad configuration:", err)
+		os.Exit(2)
+	}
+	//SIGINT or SIGTERM shuts down gracefully, a second one stops waiting
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		slog.Info("Shutting down", "signal", sig.String())
+		go func() {
+			<-sigs
+			slog.Warn("Got another signal, not waiting any more")
+			os.Exit(1)
+		}()
+		s.Shutdown(s.ShutdownTimeout)
+	}()
+	if err := s.Init(); err != nil {
+		slog.Error("Couldn't start the server", "err", err)
+		os.Exit(1)
+	}
 }
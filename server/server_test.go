@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	proto "termtexter/proto"
+)
+
+func TestCheckPost(t *testing.T) {
+	s := &Server{}
+	s.rooms.set(&proto.Room{ID: 1, Channels: map[int]*proto.Channel{10: {ID: 10}}, Users: map[int]*proto.User{100: {ID: 100}}})
+	s.rooms.set(&proto.Room{ID: 2, Channels: map[int]*proto.Channel{20: {ID: 20}}, Users: map[int]*proto.User{200: {ID: 200}}})
+	tests := []struct {
+		name    string
+		room    int
+		channel int
+		uid     int
+		reason  string
+	}{
+		{"member posting in their room", 1, 10, 100, ""},
+		{"channel from another room", 2, 10, 100, proto.ERR_NOT_FOUND},
+		{"their channel named with another room", 1, 20, 200, proto.ERR_NOT_FOUND},
+		{"room that isn't loaded", 3, 10, 100, proto.ERR_NOT_FOUND},
+		{"not a member of the room", 2, 20, 100, proto.ERR_NOT_MEMBER},
+	}
+	for _, tt := range tests {
+		err := s.checkPost(tt.room, tt.channel, tt.uid)
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%s: refused with %v", tt.name, err)
+			}
+			continue
+		}
+		var re *requestError
+		if !errors.As(err, &re) || re.Reason != tt.reason {
+			t.Errorf("%s: got %v, want a %q refusal", tt.name, err, tt.reason)
+		}
+	}
+}
+
+func TestClearSocket(t *testing.T) {
+	dir := t.TempDir()
+	if err := clearSocket(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Errorf("nothing at the path: %v", err)
+	}
+
+	file := filepath.Join(dir, "termtexter.toml")
+	if err := os.WriteFile(file, []byte("important"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := clearSocket(file); err == nil {
+		t.Error("a regular file at the socket path wasn't refused")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("the regular file was removed: %v", err)
+	}
+
+	sock := filepath.Join(dir, "old.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skip("can't make a unix socket here:", err)
+	}
+	//leave the socket file behind, like a crashed server would
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if err := clearSocket(sock); err != nil {
+		t.Errorf("old socket: %v", err)
+	}
+	if _, err := os.Lstat(sock); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("old socket is still there: %v", err)
+	}
+}
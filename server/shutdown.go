@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	proto "termtexter/proto"
+)
+
+//track - counts a new connection as open, unless we're shutting down. Every connection that gets past this
+//is in s.live before Shutdown looks, so none of them miss the going away notice
+func (s *Server) track(p *proto.Proto, lg *slog.Logger) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closing {
+		return false
+	}
+	s.clients.Add(1)
+	s.live.add(p, lg)
+	return true
+}
+
+//untrack - the connection is done
+func (s *Server) untrack(p *proto.Proto) {
+	s.wire.close(p, &s.live)
+	s.clients.Done()
+}
+
+//begin - call before handling a request, it's false once we're shutting down and the request should be turned away.
+//If it's true call end when the request is done
+func (s *Server) begin() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closing {
+		return false
+	}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) end() {
+	s.handlers.Done()
+}
+
+//Shutdown - stops the server without losing anything already posted. Stops accepting connections, tells every client
+//we're going away and when to come back, lets the requests already being handled finish, closes the connections
+//once what's queued for them is written, and closes the DB. Gives up waiting after timeout
+func (s *Server) Shutdown(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return
+	}
+	s.closing = true
+	//Init can't add to these once closing is set
+	listeners := s.listeners
+	web, admin := s.web, s.admin
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		if l.kind != LISTENER_ADMIN {
+			l.Close()
+		}
+	}
+	if web != nil {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		web.Shutdown(ctx)
+		cancel()
+	}
+
+	conns := s.live.all()
+	for _, p := range conns {
+		p.SendGoingAway("The server is restarting", s.RetryAfter)
+	}
+	slog.Info("Told connections we're going away, waiting on requests in flight", "conns", len(conns))
+	if !waitTimeout(&s.handlers, time.Until(deadline)) {
+		slog.Warn("Gave up waiting on requests in flight")
+	}
+
+	//Close lets each writer flush before hanging up, and handleClient returns once it has
+	for _, p := range s.live.all() {
+		p.Close()
+	}
+	if !waitTimeout(&s.clients, time.Until(deadline)) {
+		slog.Warn("Gave up waiting on connections to close")
+	}
+
+	if err := s.db.Close(); err != nil {
+		slog.Error("Closing the database failed", "err", err)
+	}
+	if s.UnixSocket != "" {
+		os.Remove(s.UnixSocket)
+	}
+	//last, so whoever's watching sees all of the above
+	if admin != nil {
+		admin.Close()
+	}
+	for _, l := range listeners {
+		if l.kind == LISTENER_ADMIN {
+			//in case Init hadn't got to serving it, admin.Close only closes the ones it's serving
+			l.Close()
+		}
+	}
+	slog.Info("Shut down")
+	close(s.doneChan())
+}
+
+//doneChan - closed once Shutdown has finished. Made on first use since a signal can beat Init to it
+func (s *Server) doneChan() chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+	return s.done
+}
+
+//waitTimeout - waits on wg for up to timeout, false if it ran out of time
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"container/list"
+	"log/slog"
+	"sync"
+
+	proto "termtexter/proto"
+)
+
+//registry - every logged in connection, by user id. One user can be logged in multiple places at the same time,
+//so each id has a linked list of sockets. Safe to use from any handleClient goroutine
+type registry struct {
+	mu          sync.RWMutex
+	connections map[int]*list.List
+}
+
+//add - puts a connection on the user's list. first is true if it's the only one they have
+func (r *registry) add(id int, p *proto.Proto) (first bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.connections == nil {
+		r.connections = make(map[int]*list.List)
+	}
+	//see if it has been initalized yet
+	if r.connections[id] == nil {
+		r.connections[id] = list.New()
+	}
+	r.connections[id].PushBack(p)
+	return r.connections[id].Len() == 1
+}
+
+//remove - takes a connection off the user's list. last is true if that was the final one they had
+func (r *registry) remove(id int, p *proto.Proto) (found bool, last bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.connections[id]
+	if l == nil {
+		return false, false
+	}
+	for node := l.Front(); node != nil; node = node.Next() {
+		//for this id, see if one of these connections match
+		if node.Value.(*proto.Proto) == p {
+			l.Remove(node)
+			found = true
+			break
+		}
+	}
+	if l.Len() == 0 {
+		delete(r.connections, id)
+		return found, found
+	}
+	return found, false
+}
+
+//users - how many users have at least one connection
+func (r *registry) users() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.connections)
+}
+
+//get - a copy of the user's connections, so they can be written to without holding the lock
+func (r *registry) get(id int) []*proto.Proto {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	l := r.connections[id]
+	if l == nil {
+		return nil
+	}
+	ps := make([]*proto.Proto, 0, l.Len())
+	for node := l.Front(); node != nil; node = node.Next() {
+		ps = append(ps, node.Value.(*proto.Proto))
+	}
+	return ps
+}
+
+//roomCache - every active room and who is in it, so we know where messages go without asking the database.
+//Rooms are loaded as their members log in, and kept up to date as people join, create and leave rooms
+type roomCache struct {
+	mu    sync.RWMutex
+	rooms map[int]*proto.Room
+}
+
+//set - adds a room, or replaces what we knew about it
+func (rc *roomCache) set(room *proto.Room) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.rooms == nil {
+		rc.rooms = make(map[int]*proto.Room)
+	}
+	rc.rooms[room.ID] = room
+}
+
+//leave - takes a user out of a room, forgetting the room once nobody is left in it
+func (rc *roomCache) leave(rid int, uid int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	room := rc.rooms[rid]
+	if room == nil {
+		return
+	}
+	//copy the users rather than editing them, readers may still have the old map
+	users := make(map[int]*proto.User)
+	for k, v := range room.Users {
+		if k != uid {
+			users[k] = v
+		}
+	}
+	if len(users) == 0 {
+		delete(rc.rooms, rid)
+		return
+	}
+	updated := *room
+	updated.Users = users
+	rc.rooms[rid] = &updated
+}
+
+//hasChannel - whether the channel is one of the room's
+func (rc *roomCache) hasChannel(rid int, cid int) bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	room := rc.rooms[rid]
+	return room != nil && room.Channels[cid] != nil
+}
+
+//isMember - whether the user is in the room
+func (rc *roomCache) isMember(rid int, uid int) bool {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	room := rc.rooms[rid]
+	return room != nil && room.Users[uid] != nil
+}
+
+//roomsOf - the ids of every room this user is in
+func (rc *roomCache) roomsOf(uid int) []int {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	ids := make([]int, 0)
+	for id, room := range rc.rooms {
+		if room.Users[uid] != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+//peers - the ids of everyone who shares at least one room with this user, not counting them
+func (rc *roomCache) peers(uid int) []int {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	seen := make(map[int]bool)
+	ids := make([]int, 0)
+	for _, room := range rc.rooms {
+		if room.Users[uid] == nil {
+			continue
+		}
+		for id := range room.Users {
+			if id != uid && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+//liveConns - every connection that's open right now, logged in or not, with the logger that has its fields on it
+type liveConns struct {
+	mu    sync.Mutex
+	conns map[*proto.Proto]*slog.Logger
+}
+
+func (lc *liveConns) add(p *proto.Proto, lg *slog.Logger) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.conns == nil {
+		lc.conns = make(map[*proto.Proto]*slog.Logger)
+	}
+	lc.conns[p] = lg
+}
+
+//logger - the logger for this connection, or the default one if it's already gone
+func (lc *liveConns) logger(p *proto.Proto) *slog.Logger {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lg, ok := lc.conns[p]; ok {
+		return lg
+	}
+	return slog.Default()
+}
+
+//setLogger - swaps in a logger with more fields, like once we know who they are
+func (lc *liveConns) setLogger(p *proto.Proto, lg *slog.Logger) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if _, ok := lc.conns[p]; ok {
+		lc.conns[p] = lg
+	}
+}
+
+func (lc *liveConns) remove(p *proto.Proto) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	delete(lc.conns, p)
+}
+
+func (lc *liveConns) count() int {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	return len(lc.conns)
+}
+
+//all - a copy of the open connections, safe to use without the lock
+func (lc *liveConns) all() []*proto.Proto {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	conns := make([]*proto.Proto, 0, len(lc.conns))
+	for p := range lc.conns {
+		conns = append(conns, p)
+	}
+	return conns
+}
+
+//wireStats - byte counts across every closed connection, so we can see what compression is saving
+type wireStats struct {
+	mu     sync.Mutex
+	closed proto.Stats
+}
+
+//close - takes a finished connection off live and folds it into the totals. Both happen under the lock total
+//takes, so the totals never count it twice or not at all, which would look like a counter reset to Prometheus
+func (ws *wireStats) close(p *proto.Proto, live *liveConns) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	live.remove(p)
+	ws.closed = ws.closed.Add(p.Stats())
+}
+
+//total - the closed connections plus the ones still open
+func (ws *wireStats) total(live *liveConns) proto.Stats {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	st := ws.closed
+	for _, p := range live.all() {
+		st = st.Add(p.Stats())
+	}
+	return st
+}
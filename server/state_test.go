@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	proto "termtexter/proto"
+)
+
+//testConn - a Proto on one end of a pipe, with the other end drained so sends never block
+func testConn(t *testing.T) *proto.Proto {
+	t.Helper()
+	a, b := net.Pipe()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	p := proto.New(a)
+	t.Cleanup(func() {
+		p.Close()
+		b.Close()
+	})
+	return p
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	var r registry
+	const users, conns = 8, 16
+	ps := make([]*proto.Proto, conns)
+	for i := range ps {
+		ps[i] = testConn(t)
+	}
+	var wg sync.WaitGroup
+	for uid := 0; uid < users; uid++ {
+		for _, p := range ps {
+			wg.Add(1)
+			go func(uid int, p *proto.Proto) {
+				defer wg.Done()
+				r.add(uid, p)
+				r.get(uid)
+				r.users()
+				if found, _ := r.remove(uid, p); !found {
+					t.Errorf("user %d: connection added but not found on remove", uid)
+				}
+			}(uid, p)
+		}
+	}
+	wg.Wait()
+	if n := r.users(); n != 0 {
+		t.Errorf("users after everything was removed = %d, want 0", n)
+	}
+}
+
+func TestRegistryFirstAndLast(t *testing.T) {
+	var r registry
+	p1, p2 := testConn(t), testConn(t)
+	if !r.add(1, p1) {
+		t.Error("first connection wasn't reported as first")
+	}
+	if r.add(1, p2) {
+		t.Error("second connection was reported as first")
+	}
+	if got := len(r.get(1)); got != 2 {
+		t.Errorf("get = %d connections, want 2", got)
+	}
+	if _, last := r.remove(1, p1); last {
+		t.Error("removing one of two connections was reported as last")
+	}
+	if _, last := r.remove(1, p2); !last {
+		t.Error("removing the final connection wasn't reported as last")
+	}
+	if found, _ := r.remove(1, p2); found {
+		t.Error("removed the same connection twice")
+	}
+}
+
+func TestRoomCacheConcurrent(t *testing.T) {
+	var rc roomCache
+	const rooms, users = 8, 8
+	var wg sync.WaitGroup
+	for rid := 0; rid < rooms; rid++ {
+		wg.Add(1)
+		go func(rid int) {
+			defer wg.Done()
+			room := &proto.Room{ID: rid, Users: map[int]*proto.User{}, Channels: map[int]*proto.Channel{rid: {ID: rid}}}
+			for uid := 0; uid < users; uid++ {
+				room.Users[uid] = &proto.User{ID: uid}
+			}
+			rc.set(room)
+			for uid := 0; uid < users; uid++ {
+				rc.roomsOf(uid)
+				rc.peers(uid)
+				rc.hasChannel(rid, rid)
+				rc.leave(rid, uid)
+			}
+		}(rid)
+	}
+	wg.Wait()
+	if ids := rc.roomsOf(0); len(ids) != 0 {
+		t.Errorf("rooms left after everyone left = %v, want none", ids)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+
+	ttdb "termtexter/db"
+	proto "termtexter/proto"
+)
+
+const (
+	TWO_FACTOR_TIMEOUT  = 5 * time.Minute //how long they have to enter a code once their password is accepted
+	RECOVERY_CODES      = 10
+	RECOVERY_CODE_BYTES = 5 //8 characters of base32, shown as xxxx-xxxx
+	TOTP_CODE_LENGTH    = 6
+	TOTP_PERIOD         = 30 //seconds each code is good for, what every authenticator app uses
+	TOTP_SKEW           = 1  //codes from this many periods either side still count, for phones with a slow clock
+)
+
+var errBadCode = forbidden(proto.ERR_BAD_CODE, "Incorrect code", proto.FIELD_CODE)
+
+//challenge - a login waiting on its second step
+type challenge struct {
+	p       *proto.Proto
+	uid     string
+	expires time.Time
+}
+
+//challenges - logins that got the password right and still need a code, by the token the client was given
+type challenges struct {
+	mu      sync.Mutex
+	pending map[string]challenge
+}
+
+//add - starts waiting on a code for this connection. The token is what the client sends back with it
+func (c *challenges) add(p *proto.Proto, uid string) (string, error) {
+	token, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[string]challenge)
+	}
+	now := time.Now()
+	for k, ch := range c.pending {
+		if now.After(ch.expires) {
+			delete(c.pending, k)
+		}
+	}
+	c.pending[token.String()] = challenge{p: p, uid: uid, expires: now.Add(TWO_FACTOR_TIMEOUT)}
+	return token.String(), nil
+}
+
+//get - who the challenge is for, if it's still good and it's the same connection that started it
+func (c *challenges) get(token string, p *proto.Proto) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch, ok := c.pending[token]
+	if !ok || ch.p != p || time.Now().After(ch.expires) {
+		return "", false
+	}
+	return ch.uid, true
+}
+
+func (c *challenges) remove(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, token)
+}
+
+//newRecoveryCodes - codes to hand the user
+func newRecoveryCodes() ([]string, error) {
+	var codes []string
+	for i := 0; i < RECOVERY_CODES; i++ {
+		b := make([]byte, RECOVERY_CODE_BYTES)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes = append(codes, code[:4]+"-"+code[4:])
+	}
+	return codes, nil
+}
+
+//normalRecoveryCode - a recovery code the way the database knows it, however they typed it
+func normalRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
+
+//totpStep - which time step code is for, if it's right for any close enough to now
+func totpStep(code string, secret string, now time.Time) (int64, bool) {
+	step := now.Unix() / TOTP_PERIOD
+	for i := step - TOTP_SKEW; i <= step+TOTP_SKEW; i++ {
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(i*TOTP_PERIOD, 0),
+			totp.ValidateOpts{Period: TOTP_PERIOD, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+//useTOTPCode - whether code is right for the user's secret, and newer than the last one they used. Each code only
+//works once, so one seen over their shoulder or in a log is no good however quickly it's used
+func (s *Server) useTOTPCode(uid string, secret string, code string, now time.Time) (bool, error) {
+	step, ok := totpStep(code, secret, now)
+	if !ok {
+		return false, nil
+	}
+	return s.db.UseTOTPStep(uid, step)
+}
+
+//isTOTPCode - whether it looks like a code from an authenticator app, rather than a recovery code
+func isTOTPCode(code string) bool {
+	if len(code) != TOTP_CODE_LENGTH {
+		return false
+	}
+	//not Atoi, that takes a sign
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+//checkCode - whether code is the user's current TOTP code, or one of their recovery codes (which is then used up)
+func (s *Server) checkCode(p *proto.Proto, uid string, code string) (bool, error) {
+	secret, enabled, err := s.db.GetTwoFactor(uid)
+	if err != nil || !enabled {
+		return false, err
+	}
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if isTOTPCode(code) {
+		return s.useTOTPCode(uid, secret, code, time.Now())
+	}
+	used, err := s.db.UseRecoveryCode(uid, normalRecoveryCode(code))
+	if used {
+		s.log(p).Warn("Recovery code used", "user", uid)
+	}
+	return used, err
+}
+
+//guardedCode - checkCode, with wrong codes counted like wrong passwords so they can't be guessed
+func (s *Server) guardedCode(p *proto.Proto, uid string, code string) error {
+	if code == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Code cannot be empty", proto.FIELD_CODE)
+	}
+	now := time.Now()
+	attempts, err := s.db.GetLoginAttempts(uid)
+	if err != nil {
+		return err
+	}
+	if err := loginRefused(s.loginWait(attempts, now)); err != nil {
+		return err
+	}
+	valid, err := s.checkCode(p, uid, code)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		s.log(p).Info("Bad two-factor code")
+		if _, err := s.userFailed(uid, now); err != nil {
+			return err
+		}
+		return errBadCode
+	}
+	if attempts != (ttdb.LoginAttempts{}) {
+		return s.db.SetLoginAttempts(uid, ttdb.LoginAttempts{})
+	}
+	return nil
+}
+
+//requireTwoFactor - refuses room admin actions from users without two-factor, when the config says admins need it
+func (s *Server) requireTwoFactor(uid string) error {
+	if !s.TwoFactorAdmins {
+		return nil
+	}
+	_, enabled, err := s.db.GetTwoFactor(uid)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return forbidden(proto.ERR_TWO_FACTOR_REQUIRED, "Room admins need two-factor authentication turned on", "")
+	}
+	return nil
+}
+
+//handleTwoFactorLogin - the second step of a login, after handleLogin sent them a challenge
+func (s *Server) handleTwoFactorLogin(tf proto.TwoFactorLogin, p *proto.Proto) (int, error) {
+	id, ok := s.challenges.get(tf.Challenge, p)
+	if !ok {
+		return -1, forbidden(proto.ERR_BAD_TOKEN, "That login has expired, log in again", "")
+	}
+	if err := s.guardedCode(p, id, tf.OTP); err != nil {
+		return -1, err
+	}
+	s.challenges.remove(tf.Challenge)
+	intid, err := strconv.Atoi(id)
+	if err != nil {
+		return -1, err
+	}
+	return intid, s.startSession(p, id, intid, tf.RequestID)
+}
+
+//handleTwoFactorSetup - a new secret for them to put in their app. Two-factor stays off until they confirm it
+func (s *Server) handleTwoFactorSetup(ts proto.TwoFactorSetupRequest, p *proto.Proto) error {
+	id, err := s.userFromKey(ts.Key)
+	if err != nil {
+		return err
+	}
+	_, enabled, err := s.db.GetTwoFactor(id)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		//otherwise a session left open somewhere could swap the secret for one the attacker has
+		return badRequest(proto.ERR_EXISTS, "Two-factor authentication is already on, turn it off first", "")
+	}
+	username, err := s.db.GetUsername(id)
+	if err != nil {
+		return err
+	}
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: s.TwoFactorIssuer, AccountName: username})
+	if err != nil {
+		return err
+	}
+	if err := s.db.SetTwoFactorSecret(id, key.Secret()); err != nil {
+		return err
+	}
+	return p.SendTwoFactorSetupResponse(ts.RequestID, key.Secret(), key.URL())
+}
+
+//handleTwoFactorEnable - turns two-factor on once they show their app has the secret, and hands out recovery codes
+func (s *Server) handleTwoFactorEnable(te proto.TwoFactorEnableRequest, p *proto.Proto) error {
+	id, err := s.userFromKey(te.Key)
+	if err != nil {
+		return err
+	}
+	if te.OTP == "" {
+		return badRequest(proto.ERR_EMPTY_FIELD, "Code cannot be empty", proto.FIELD_CODE)
+	}
+	secret, enabled, err := s.db.GetTwoFactor(id)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return badRequest(proto.ERR_EXISTS, "Two-factor authentication is already on", "")
+	}
+	if secret == "" {
+		return badRequest(proto.ERR_NOT_FOUND, "Set up two-factor authentication first", "")
+	}
+	//using it here counts, so the same code can't log them in straight after
+	valid, err := s.useTOTPCode(id, secret, strings.ReplaceAll(strings.TrimSpace(te.OTP), " ", ""), time.Now())
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return errBadCode
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		return err
+	}
+	normal := make([]string, len(codes))
+	for i, code := range codes {
+		normal[i] = normalRecoveryCode(code)
+	}
+	if err := s.db.EnableTwoFactor(id, normal); err != nil {
+		return err
+	}
+	s.log(p).Info("Two-factor turned on")
+	return p.SendTwoFactorEnableResponse(te.RequestID, codes)
+}
+
+//handleTwoFactorDisable - turns two-factor off, if they can still produce a code and aren't an admin who needs it
+func (s *Server) handleTwoFactorDisable(td proto.TwoFactorDisableRequest, p *proto.Proto) error {
+	id, err := s.userFromKey(td.Key)
+	if err != nil {
+		return err
+	}
+	_, enabled, err := s.db.GetTwoFactor(id)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return badRequest(proto.ERR_NOT_FOUND, "Two-factor authentication isn't on", "")
+	}
+	if s.TwoFactorAdmins {
+		admin, err := s.db.IsAnyRoomAdmin(id)
+		if err != nil {
+			return err
+		}
+		if admin {
+			return forbidden(proto.ERR_TWO_FACTOR_REQUIRED, "Room admins have to keep two-factor authentication on", "")
+		}
+	}
+	if err := s.guardedCode(p, id, td.OTP); err != nil {
+		return err
+	}
+	if err := s.db.DisableTwoFactor(id); err != nil {
+		return err
+	}
+	s.log(p).Info("Two-factor turned off")
+	return p.SendTwoFactorDisableResponse(td.RequestID)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+const testSecret = "JBSWY3DPEHPK3PXP"
+
+//testNow - the middle of a time step, so a second either way doesn't change which one it is
+var testNow = time.Unix(1700000010, 0)
+
+//codeAt - the code an authenticator app would show steps periods from testNow
+func codeAt(t *testing.T, steps int) string {
+	t.Helper()
+	code, err := totp.GenerateCodeCustom(testSecret, testNow.Add(time.Duration(steps*TOTP_PERIOD)*time.Second),
+		totp.ValidateOpts{Period: TOTP_PERIOD, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPStep(t *testing.T) {
+	base := testNow.Unix() / TOTP_PERIOD
+	tests := []struct {
+		name  string
+		steps int
+		ok    bool
+	}{
+		{"current", 0, true},
+		{"one step early", -1, true},
+		{"one step late", 1, true},
+		{"two steps early", -2, false},
+		{"two steps late", 2, false},
+	}
+	for _, tt := range tests {
+		step, ok := totpStep(codeAt(t, tt.steps), testSecret, testNow)
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && step != base+int64(tt.steps) {
+			t.Errorf("%s: step = %d, want %d", tt.name, step, base+int64(tt.steps))
+		}
+	}
+	if _, ok := totpStep(codeAt(t, 0), "GEZDGNBVGY3TQOJQ", testNow); ok {
+		t.Error("a code for another secret was accepted")
+	}
+}
+
+//stepDriver - just enough of a database for UseTOTPStep, keeping each user's last step in memory
+type stepDriver struct {
+	mu   sync.Mutex
+	last map[string]int64
+}
+
+func (d *stepDriver) Open(string) (driver.Conn, error) { return stepConn{d}, nil }
+
+type stepConn struct{ d *stepDriver }
+
+func (c stepConn) Prepare(query string) (driver.Stmt, error) {
+	if !strings.HasPrefix(query, "update users set totp_last_step") {
+		return nil, errors.New("stepDriver: unexpected query " + query)
+	}
+	return stepStmt{c.d}, nil
+}
+func (stepConn) Close() error              { return nil }
+func (stepConn) Begin() (driver.Tx, error) { return nil, errors.New("stepDriver: no transactions") }
+
+type stepStmt struct{ d *stepDriver }
+
+func (stepStmt) Close() error  { return nil }
+func (stepStmt) NumInput() int { return 3 }
+func (stepStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("stepDriver: no queries")
+}
+
+//Exec - set totp_last_step = ? where user_id = ? and (totp_last_step is null or totp_last_step < ?)
+func (s stepStmt) Exec(args []driver.Value) (driver.Result, error) {
+	step, uid := args[0].(int64), args[1].(string)
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	if last, ok := s.d.last[uid]; ok && last >= step {
+		return driver.RowsAffected(0), nil
+	}
+	s.d.last[uid] = step
+	return driver.RowsAffected(1), nil
+}
+
+var registerStepDriver sync.Once
+
+func TestTOTPReplay(t *testing.T) {
+	registerStepDriver.Do(func() {
+		sql.Register("totpsteps", &stepDriver{last: make(map[string]int64)})
+	})
+	s := &Server{}
+	if err := s.db.Connect("totpsteps", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	tests := []struct {
+		name  string
+		uid   string
+		steps int
+		ok    bool
+	}{
+		{"first use", "1", 0, true},
+		{"same code again", "1", 0, false},
+		{"earlier step after a later one", "1", -1, false},
+		{"next step", "1", 1, true},
+		{"next step reused", "1", 1, false},
+		{"another user's steps are their own", "2", 0, true},
+	}
+	for _, tt := range tests {
+		ok, err := s.useTOTPCode(tt.uid, testSecret, codeAt(t, tt.steps), testNow)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ok != tt.ok {
+			t.Errorf("%s: ok = %v, want %v", tt.name, ok, tt.ok)
+		}
+	}
+}
+
+func TestNormalRecoveryCode(t *testing.T) {
+	tests := []struct {
+		typed string
+		want  string
+	}{
+		{"abcd-efgh", "abcdefgh"},
+		{"abcdefgh", "abcdefgh"},
+		{"ABCD-EFGH", "abcdefgh"},
+		{"AbCd-eFgH", "abcdefgh"},
+		{"abcd efgh", "abcdefgh"},
+		{"  abcd-efgh\n", "abcdefgh"},
+		{"ab-cd-ef-gh", "abcdefgh"},
+	}
+	for _, tt := range tests {
+		if got := normalRecoveryCode(tt.typed); got != tt.want {
+			t.Errorf("normalRecoveryCode(%q) = %q, want %q", tt.typed, got, tt.want)
+		}
+	}
+	codes, err := newRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != RECOVERY_CODES {
+		t.Errorf("got %d recovery codes, want %d", len(codes), RECOVERY_CODES)
+	}
+	for _, code := range codes {
+		//the way they're shown has to come back to the way they're stored, and never look like a TOTP code
+		if normalRecoveryCode(strings.ToUpper(code)) != strings.ReplaceAll(code, "-", "") || isTOTPCode(code) {
+			t.Errorf("recovery code %q doesn't survive being typed back in", code)
+		}
+	}
+}
+
+func TestIsTOTPCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"123456", true},
+		{"000000", true},
+		{"12345", false},
+		{"1234567", false},
+		{"12345a", false},
+		{"+12345", false},
+		{"-12345", false},
+		{"abcd-efgh", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isTOTPCode(tt.code); got != tt.want {
+			t.Errorf("isTOTPCode(%q) = %v, want %v", tt.code, got, tt.want)
+		}
+	}
+}
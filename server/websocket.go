@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+
+	proto "termtexter/proto"
+
+	"github.com/coder/websocket"
+)
+
+const (
+	WEBSOCKET_PATH = "/ws"
+)
+
+//webSocketServer - the same protocol as the TCP listener but over WebSocket, for people behind proxies that only allow HTTP(S).
+//Each packet is one binary message
+func (s *Server) webSocketServer() *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(WEBSOCKET_PATH, func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			slog.Debug("WebSocket upgrade failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		//packets can be as big as a frame, plus whatever compression adds on a bad day
+		ws.SetReadLimit(2 * proto.MAX_FRAME)
+		//handleClient returns when they leave, the request has to stay open until then
+		s.handleClient(websocket.NetConn(context.Background(), ws, websocket.MessageBinary))
+	})
+	return &http.Server{Handler: mux, TLSConfig: s.TLS}
+}
+
+//serveWebSocket - runs s.web on listener, with TLS (for wss://) if the server has it
+func (s *Server) serveWebSocket(listener net.Listener) {
+	var err error
+	if s.TLS != nil {
+		err = s.web.ServeTLS(listener, "", "")
+	} else {
+		err = s.web.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		slog.Error("WebSocket listener stopped", "err", err)
+	}
+}
@@ -47,6 +47,23 @@ LOCK TABLES `messages` WRITE;
 /*!40000 ALTER TABLE `messages` ENABLE KEYS */;
 UNLOCK TABLES;
 
+--
+-- Table structure for table `recovery_codes`
+--
+
+DROP TABLE IF EXISTS `recovery_codes`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `recovery_codes` (
+  `recovery_code_id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `code` varchar(64) NOT NULL,
+  PRIMARY KEY (`recovery_code_id`),
+  KEY `user_id` (`user_id`),
+  CONSTRAINT `recovery_codes_ibfk_1` FOREIGN KEY (`user_id`) REFERENCES `users` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=latin1;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
 --
 -- Table structure for table `room_users`
 --
@@ -122,7 +139,16 @@ CREATE TABLE `users` (
   `password` varchar(200) NOT NULL,
   `created` timestamp NOT NULL DEFAULT current_timestamp(),
   `displayname` varchar(100) NOT NULL DEFAULT `username`,
-  PRIMARY KEY (`user_id`)
+  `failed_logins` int(11) NOT NULL DEFAULT 0,
+  `last_failed_login` timestamp NULL DEFAULT NULL,
+  `locked_until` timestamp NULL DEFAULT NULL,
+  `reset_token` varchar(64) DEFAULT NULL,
+  `reset_expires` timestamp NULL DEFAULT NULL,
+  `totp_secret` varchar(64) DEFAULT NULL,
+  `totp_enabled` tinyint(1) NOT NULL DEFAULT 0,
+  `totp_last_step` bigint(20) DEFAULT NULL,
+  PRIMARY KEY (`user_id`),
+  UNIQUE KEY `users_reset_token` (`reset_token`)
 ) ENGINE=InnoDB AUTO_INCREMENT=5 DEFAULT CHARSET=latin1;
 /*!40101 SET character_set_client = @saved_cs_client */;
 